@@ -0,0 +1,421 @@
+package rbuilder
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Group is the element of groupBy result: elements of the list with the
+// same key, in the order of the list.
+type Group struct {
+	Key   interface{}
+	Items []interface{}
+}
+
+// listItems returns elements of the slice, the array or the map, map
+// elements are ordered by keys as {{range}} does.
+func listItems(list interface{}) ([]reflect.Value, error) {
+
+	val := reflect.ValueOf(list)
+	for val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface {
+		if val.IsNil() {
+			return nil, nil
+		}
+		val = val.Elem()
+	}
+
+	switch val.Kind() {
+	case reflect.Invalid:
+		return nil, nil
+	case reflect.Array, reflect.Slice:
+		res := make([]reflect.Value, 0, val.Len())
+		for i := 0; i < val.Len(); i++ {
+			res = append(res, val.Index(i))
+		}
+		return res, nil
+	case reflect.Map:
+		keys := val.MapKeys()
+		sortKeys(keys)
+		res := make([]reflect.Value, 0, len(keys))
+		for _, k := range keys {
+			res = append(res, val.MapIndex(k))
+		}
+		return res, nil
+	}
+
+	return nil, fmt.Errorf("slice or map expected, got %T", list)
+}
+
+// fieldValue returns the field of the element by the path like
+// "Doctor.Price". Path elements are struct fields, methods without
+// arguments or keys of maps. Empty path returns the element itself.
+func fieldValue(v reflect.Value, path string) (reflect.Value, error) {
+
+	if path == "" {
+		return v, nil
+	}
+
+	for _, name := range strings.Split(path, ".") {
+		for v.Kind() == reflect.Interface && !v.IsNil() {
+			v = v.Elem()
+		}
+
+		if m := method(v, name); m.IsValid() {
+			v = m.Call(nil)[0]
+			continue
+		}
+
+		for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+			if v.IsNil() {
+				return reflect.Value{}, fmt.Errorf("nil pointer evaluating %s", name)
+			}
+			v = v.Elem()
+		}
+
+		switch v.Kind() {
+		case reflect.Struct:
+			f := v.FieldByName(name)
+			if !f.IsValid() {
+				return reflect.Value{}, fmt.Errorf("can't evaluate field %s in type %s", name, v.Type())
+			}
+			v = f
+		case reflect.Map:
+			if v.Type().Key().Kind() != reflect.String {
+				return reflect.Value{}, fmt.Errorf("can't evaluate key %s in type %s", name, v.Type())
+			}
+			f := v.MapIndex(reflect.ValueOf(name).Convert(v.Type().Key()))
+			if !f.IsValid() {
+				return reflect.Value{}, fmt.Errorf("map has no entry for key %q", name)
+			}
+			v = f
+		default:
+			return reflect.Value{}, fmt.Errorf("can't evaluate field %s of %s", name, v.Kind())
+		}
+	}
+
+	return v, nil
+}
+
+// method returns the method of the value what has no arguments and returns
+// single value, methods of the pointer are found for addressable value.
+func method(v reflect.Value, name string) reflect.Value {
+
+	if !v.IsValid() || v.Kind() == reflect.Interface {
+		return reflect.Value{}
+	}
+
+	m := v.MethodByName(name)
+	if !m.IsValid() && v.Kind() != reflect.Ptr && v.CanAddr() {
+		m = v.Addr().MethodByName(name)
+	}
+
+	if !m.IsValid() || m.Type().NumIn() != 0 || m.Type().NumOut() != 1 {
+		return reflect.Value{}
+	}
+
+	return m
+}
+
+// fieldPath returns the optional field argument of aggregate function.
+func fieldPath(field []string) (string, error) {
+	switch len(field) {
+	case 0:
+		return "", nil
+	case 1:
+		return field[0], nil
+	}
+	return "", fmt.Errorf("only one field is expected, got %d", len(field))
+}
+
+// numbers returns values of the field of list elements.
+func numbers(list interface{}, field []string) ([]*big.Rat, error) {
+
+	path, err := fieldPath(field)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := listItems(list)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*big.Rat, 0, len(items))
+	for _, item := range items {
+		v, err := fieldValue(item, path)
+		if err != nil {
+			return nil, err
+		}
+		if !v.CanInterface() {
+			return nil, fmt.Errorf("can't use unexported field %s", path)
+		}
+		f, err := toFloat(v.Interface())
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, decimalRat(f))
+	}
+
+	return res, nil
+}
+
+func ratSum(nums []*big.Rat) *big.Rat {
+	res := new(big.Rat)
+	for _, n := range nums {
+		res.Add(res, n)
+	}
+	return res
+}
+
+func ratFloat(r *big.Rat) float64 {
+	f, _ := r.Float64()
+	return f
+}
+
+// sumFunc is {{sum .D.Services "Price"}}: exact decimal sum of the field of
+// list elements, elements themselves are summed without field.
+func sumFunc(list interface{}, field ...string) (float64, error) {
+	nums, err := numbers(list, field)
+	if err != nil {
+		return 0, err
+	}
+	return ratFloat(ratSum(nums)), nil
+}
+
+// avgFunc is {{avg .D.Services "Price"}}: average of the field of list
+// elements, 0 for empty list.
+func avgFunc(list interface{}, field ...string) (float64, error) {
+	nums, err := numbers(list, field)
+	if err != nil || len(nums) == 0 {
+		return 0, err
+	}
+	sum := ratSum(nums)
+	return ratFloat(sum.Quo(sum, new(big.Rat).SetInt64(int64(len(nums))))), nil
+}
+
+// minFunc is {{min .D.Services "Price"}}: the least value of the field of
+// list elements, 0 for empty list.
+func minFunc(list interface{}, field ...string) (float64, error) {
+	return extremum(list, field, -1)
+}
+
+// maxFunc is {{max .D.Services "Price"}}: the greatest value of the field
+// of list elements, 0 for empty list.
+func maxFunc(list interface{}, field ...string) (float64, error) {
+	return extremum(list, field, 1)
+}
+
+// extremum returns value what is compared as sign with all other values.
+func extremum(list interface{}, field []string, sign int) (float64, error) {
+	nums, err := numbers(list, field)
+	if err != nil || len(nums) == 0 {
+		return 0, err
+	}
+	res := nums[0]
+	for _, n := range nums[1:] {
+		if n.Cmp(res) == sign {
+			res = n
+		}
+	}
+	return ratFloat(res), nil
+}
+
+// countFunc is {{count .D.Services}}: amount of list elements. With field
+// only elements where the field is not empty are counted, like
+// {{count .D.Services "Discount"}}.
+func countFunc(list interface{}, field ...string) (int, error) {
+
+	path, err := fieldPath(field)
+	if err != nil {
+		return 0, err
+	}
+
+	items, err := listItems(list)
+	if err != nil || path == "" {
+		return len(items), err
+	}
+
+	n := 0
+	for _, item := range items {
+		v, err := fieldValue(item, path)
+		if err != nil {
+			return 0, err
+		}
+		if !isEmpty(v) {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// isEmpty tells if the value is zero, empty or nil.
+func isEmpty(v reflect.Value) bool {
+	for v.Kind() == reflect.Interface && !v.IsNil() {
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return true
+	}
+	switch v.Kind() {
+	case reflect.Array, reflect.Slice, reflect.Map, reflect.String, reflect.Chan:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface, reflect.Func:
+		return v.IsNil()
+	}
+	if !v.CanInterface() {
+		return false
+	}
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+// groupByFunc is {{range groupBy .D.Shipments "Route"}}: elements of the
+// list grouped by the key, groups keep the order of the first elements.
+// Key is the path of fields, methods without arguments or map keys of the
+// element. Key of time.Time type is formatted by the optional layout, so
+// {{groupBy .D.Shipments "Date" "02.01.2006"}} groups elements by days.
+// Other keys are computed by the function of the element what returns the
+// key and optional error, like {{groupBy .D.Shipments .S.ByWeek}} where
+// ByWeek is the field of func type, templates can not declare functions.
+func groupByFunc(list interface{}, key interface{}, layout ...string) ([]Group, error) {
+
+	keyOf, err := groupKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(layout) > 1 {
+		return nil, fmt.Errorf("groupBy: only one layout is expected, got %d", len(layout))
+	}
+
+	items, err := listItems(list)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []Group
+	index := make(map[interface{}]int)
+
+	for _, item := range items {
+		v, err := keyOf(item)
+		if err != nil {
+			return nil, err
+		}
+
+		for v.Kind() == reflect.Interface && !v.IsNil() {
+			v = v.Elem()
+		}
+
+		var k interface{}
+		if v.IsValid() {
+			if !v.CanInterface() {
+				return nil, fmt.Errorf("groupBy: can't use unexported field %v", key)
+			}
+			if !v.Type().Comparable() {
+				return nil, fmt.Errorf("groupBy: key of type %s is not comparable", v.Type())
+			}
+			k = v.Interface()
+		}
+
+		if t, ok := k.(time.Time); ok && len(layout) > 0 {
+			k = t.Format(layout[0])
+		}
+
+		i, ok := index[k]
+		if !ok {
+			i = len(res)
+			index[k] = i
+			res = append(res, Group{Key: k})
+		}
+		res[i].Items = append(res[i].Items, item.Interface())
+	}
+
+	return res, nil
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// groupKey returns function what evaluates the key of groupBy for the
+// element. Key is the path of fields or the function of the element.
+func groupKey(key interface{}) (func(reflect.Value) (reflect.Value, error), error) {
+
+	if path, ok := key.(string); ok {
+		if path == "" {
+			return nil, errors.New("groupBy: key is not set")
+		}
+		return func(item reflect.Value) (reflect.Value, error) {
+			return fieldValue(item, path)
+		}, nil
+	}
+
+	fn := reflect.ValueOf(key)
+	if fn.Kind() != reflect.Func || fn.IsNil() {
+		return nil, fmt.Errorf("groupBy: key must be the path of fields or the function, got %T", key)
+	}
+
+	ft := fn.Type()
+	if ft.NumIn() != 1 || ft.NumOut() < 1 || ft.NumOut() > 2 || (ft.NumOut() == 2 && ft.Out(1) != errorType) {
+		return nil, fmt.Errorf("groupBy: key function %s must get the element and return the key and optional error", ft)
+	}
+
+	return func(item reflect.Value) (reflect.Value, error) {
+
+		for item.Kind() == reflect.Interface && !item.IsNil() {
+			item = item.Elem()
+		}
+
+		arg := reflect.Zero(ft.In(0))
+		if item.IsValid() && !(item.Kind() == reflect.Interface && item.IsNil()) {
+			if !item.Type().AssignableTo(ft.In(0)) {
+				return reflect.Value{}, fmt.Errorf("groupBy: element of type %s can't be passed to key function %s", item.Type(), ft)
+			}
+			arg = item
+		}
+
+		out := fn.Call([]reflect.Value{arg})
+		if len(out) == 2 && !out[1].IsNil() {
+			return reflect.Value{}, fmt.Errorf("groupBy: %v", out[1].Interface())
+		}
+
+		return out[0], nil
+	}, nil
+}
+
+// Методы группы используются в строках заголовка и итогов группы:
+// {{.Key}}, {{.First.Route}}, {{.Sum "Weight"}}.
+
+// First returns the first element of the group.
+func (g Group) First() interface{} {
+	if len(g.Items) == 0 {
+		return nil
+	}
+	return g.Items[0]
+}
+
+// Count returns amount of elements of the group, see count function.
+func (g Group) Count(field ...string) (int, error) {
+	return countFunc(g.Items, field...)
+}
+
+// Sum returns sum of the field of the group elements, see sum function.
+func (g Group) Sum(field ...string) (float64, error) {
+	return sumFunc(g.Items, field...)
+}
+
+// Avg returns average of the field of the group elements.
+func (g Group) Avg(field ...string) (float64, error) {
+	return avgFunc(g.Items, field...)
+}
+
+// Min returns the least value of the field of the group elements.
+func (g Group) Min(field ...string) (float64, error) {
+	return minFunc(g.Items, field...)
+}
+
+// Max returns the greatest value of the field of the group elements.
+func (g Group) Max(field ...string) (float64, error) {
+	return maxFunc(g.Items, field...)
+}
@@ -0,0 +1,149 @@
+package rbuilder
+
+import (
+	"math"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tealeg/xlsx"
+)
+
+const (
+	// defaultFontSize is the size of the font of the cell without style.
+	defaultFontSize = 11
+	// defaultColWidth is the width of Excel column in characters.
+	defaultColWidth = 8.43
+	// lineSpacing is the height of the text line to the font size, Excel
+	// row with 11pt font is 15pt high.
+	lineSpacing = 1.36
+)
+
+// markFit remembers rows of the element for WithAutoFitRows.
+func (rr *renderer) markFit(rows []*xlsx.Row) {
+
+	if !rr.autoFit {
+		return
+	}
+
+	if rr.fit == nil {
+		rr.fit = make(map[*xlsx.Row]bool)
+	}
+	for _, row := range rows {
+		rr.fit[row] = true
+	}
+}
+
+// fitRows sets heights of rows marked by markFit.
+func (rr *renderer) fitRows() {
+
+	if len(rr.fit) == 0 {
+		return
+	}
+
+	for _, sheet := range rr.report.Sheets {
+		for _, row := range sheet.Rows {
+			if rr.fit[row] {
+				fitRow(sheet, row)
+			}
+		}
+	}
+}
+
+// fitRow makes the row high enough for wrapped text of its cells. Height is
+// estimated from the length of the text, width of the column and the font
+// size, the row is never made lower than in the template. Returns true if
+// the height is changed.
+func fitRow(sheet *xlsx.Sheet, row *xlsx.Row) bool {
+
+	height := row.Height
+	if height == 0 {
+		height = sheet.SheetFormat.DefaultRowHeight
+	}
+	if height == 0 {
+		height = defaultFontSize * lineSpacing
+	}
+
+	need := 0.0
+	for c, cell := range row.Cells {
+		if cell.Value == "" || cell.Formula() != "" || cell.VMerge > 0 {
+			continue
+		}
+
+		// GetStyle добавляет стиль ячейке без стиля, поэтому стиль
+		// читается из копии ячейки
+		tmp := *cell
+		st := tmp.GetStyle()
+		if !st.Alignment.WrapText {
+			continue
+		}
+
+		width := 0.0
+		for k := c; k <= c+cell.HMerge; k++ {
+			width += colWidth(sheet, k)
+		}
+
+		size := float64(st.Font.Size)
+		if size <= 0 {
+			size = defaultFontSize
+		}
+
+		// ширина колонки измеряется в символах шрифта по умолчанию
+		perLine := int(width * defaultFontSize / size)
+		if h := float64(wrapLines(cell.Value, perLine)) * size * lineSpacing; h > need {
+			need = h
+		}
+	}
+
+	if need <= height {
+		return false
+	}
+
+	row.SetHeight(math.Ceil(need*4) / 4)
+
+	return true
+}
+
+// colWidth returns width of the column c of the sheet in characters.
+func colWidth(sheet *xlsx.Sheet, c int) float64 {
+
+	if c < len(sheet.Cols) && sheet.Cols[c] != nil && sheet.Cols[c].Width > 0 {
+		return sheet.Cols[c].Width
+	}
+	if sheet.SheetFormat.DefaultColWidth > 0 {
+		return sheet.SheetFormat.DefaultColWidth
+	}
+
+	return defaultColWidth
+}
+
+// wrapLines returns amount of lines what text takes when it is wrapped by
+// words into lines of perLine characters. Words longer than the line are
+// broken.
+func wrapLines(text string, perLine int) int {
+
+	if perLine < 1 {
+		perLine = 1
+	}
+
+	lines := 0
+	for _, par := range strings.Split(text, "\n") {
+		lines++
+		used := 0
+		for _, word := range strings.Fields(par) {
+			n := utf8.RuneCountInString(word)
+			switch {
+			case used == 0:
+			case used+1+n <= perLine:
+				used += 1 + n
+				continue
+			default:
+				lines++
+			}
+			// длинное слово занимает несколько строк
+			lines += (n - 1) / perLine
+			used = (n-1)%perLine + 1
+		}
+	}
+
+	return lines
+}
@@ -0,0 +1,708 @@
+package rbuilder
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"text/template"
+	"text/template/parse"
+
+	"github.com/tealeg/xlsx"
+)
+
+// rangeEndTag closes {{range}} of the block of rows.
+const rangeEndTag = "{{end.}}"
+
+// colEndTag closes {{range}} what is placed in single cell and repeats
+// the column of the cell to the right for each element.
+const colEndTag = "{{endcol.}}"
+
+// compiled is the parsed template workbook. Placeholders of every cell are
+// compiled to separate text/template templates and grouped by range blocks.
+type compiled struct {
+	sheets []*tmplSheet
+}
+
+// tmplSheet holds cells what are outside of range blocks and top level
+// range blocks of the sheet.
+type tmplSheet struct {
+	name   string
+	cells  []*tmplCell
+	blocks []*tmplBlock
+}
+
+// tmplBlock is {{range}}{{end.}} block. Block starts in the row where
+// {{range}} is met and lasts till the row where {{end.}} is met, so one
+// element of the range is rendered into band of several rows. Blocks can be
+// nested, nested block occupies part of rows of outer block. Every cell of
+// the rows of the block belongs to it, also cells to the left of {{range}}
+// and to the right of {{end.}}. {{if}}{{end.}} block keeps its rows if the
+// condition is true and removes them otherwise.
+type tmplBlock struct {
+	top    int
+	height int
+	// pipe evaluates range expression and captures its value
+	pipe   *template.Template
+	cells  []*tmplCell
+	blocks []*tmplBlock
+	// decl holds variables declared by {{range}}, like "$i, $v := "
+	decl string
+	// loc is the cell what opens the block
+	loc location
+}
+
+// tmplCell is a cell with placeholders. Row of the cell is relative to the
+// top of the block the cell belongs to.
+type tmplCell struct {
+	row  int
+	col  int
+	tmpl *template.Template
+	// pipe is set for {{range}}{{endcol.}} cell, it evaluates range
+	// expression, tmpl renders one element of the range.
+	pipe *template.Template
+	// value is set for the cell what is single {{pipeline}}, it captures
+	// value of the pipeline, so the type of the value is kept
+	value *template.Template
+	// above is the last block of the same level what ends above the cell,
+	// {{total}} of the cell sums rows of the block
+	above *tmplBlock
+	loc   location
+}
+
+// parser parses texts of cells with functions and options of the template.
+type parser struct {
+	funcs template.FuncMap
+	// strict is set by WithStrictKeys
+	strict bool
+}
+
+// compile parses every cell with placeholders of the workbook.
+func compile(f *xlsx.File, p parser) (*compiled, error) {
+
+	if len(f.Sheets) == 0 {
+		return nil, errors.New("report has not scheets")
+	}
+
+	res := &compiled{sheets: make([]*tmplSheet, 0, len(f.Sheets))}
+	for _, sheet := range f.Sheets {
+		ts, err := compileSheet(sheet, p)
+		if err != nil {
+			return nil, err
+		}
+		res.sheets = append(res.sheets, ts)
+	}
+
+	return res, nil
+}
+
+func compileSheet(sheet *xlsx.Sheet, p parser) (*tmplSheet, error) {
+
+	ts := &tmplSheet{name: sheet.Name}
+
+	// stack holds opened blocks, last one is the innermost
+	stack := make([]*tmplBlock, 0)
+
+	for r, row := range sheet.Rows {
+
+		// строка копируется целиком, поэтому все ячейки строки принадлежат
+		// самому вложенному блоку строки: ячейка, открывающая блок,
+		// разбирается первой, блоки закрываются после всех ячеек строки
+		cells := make([]int, 0, len(row.Cells))
+		opened := false
+		for c, cell := range row.Cells {
+			val := cell.Value
+			if !(strings.Contains(val, "{{") && strings.Contains(val, "}}")) {
+				continue
+			}
+			if !opened && p.opensBlock(cellName(sheet.Name, r, c), stackDecls(stack), val) {
+				opened = true
+				cells = append([]int{c}, cells...)
+				continue
+			}
+			cells = append(cells, c)
+		}
+
+		ends := 0
+		var endLoc location
+
+		for _, c := range cells {
+			val := row.Cells[c].Value
+
+			name := cellName(sheet.Name, r, c)
+			loc := location{sheet: sheet.Name, row: r, col: c, text: val}
+			if n := strings.Count(val, rangeEndTag); n > 0 {
+				ends += n
+				endLoc = loc
+			}
+			val = strings.Replace(val, rangeEndTag, "", -1)
+
+			decls := stackDecls(stack)
+
+			if err := p.checkCell(name, decls, val); err != nil {
+				return nil, loc.error(ParseError, err)
+			}
+
+			tc := &tmplCell{col: c, loc: loc}
+
+			if strings.Contains(val, colEndTag) {
+				// {{range}}{{endcol.}} cell, text around the range is
+				// rendered into every cell of the range
+				if strings.Count(val, colEndTag) > 1 {
+					return nil, loc.error(ParseError, fmt.Errorf("only one %s per cell is supported", colEndTag))
+				}
+
+				idx := strings.Index(val, colEndTag)
+				rng, err := splitRange(name, decls, val[:idx]+"{{end}}", p)
+				if err != nil {
+					return nil, loc.error(ParseError, err)
+				}
+
+				if tc.pipe, err = p.parse(name, wrapFrames(decls, rng.capture())); err != nil {
+					return nil, loc.error(ParseError, err)
+				}
+
+				text := rng.prefix + rangeFrame(len(decls), rng.decl, rng.body) + val[idx+len(colEndTag):]
+				if tc.tmpl, err = p.parse(name, wrapFrames(decls, text)); err != nil {
+					return nil, loc.error(ParseError, err)
+				}
+			} else if tmpl, err := p.parse(name, wrapFrames(decls, val)); err == nil {
+				// cell has no unclosed {{range}}
+				tc.tmpl = tmpl
+				if tc.value, err = parseValue(name, decls, tmpl, p); err != nil {
+					return nil, loc.error(ParseError, err)
+				}
+			} else {
+				// cell should open the block, {{range}} is closed by {{end.}}
+				// in the same or one of the next rows
+				rng, err2 := splitRange(name, decls, val+"{{end}}", p)
+				if err2 != nil {
+					return nil, loc.error(ParseError, err)
+				}
+
+				b := &tmplBlock{top: r, decl: rng.decl, loc: loc}
+				if b.pipe, err = p.parse(name, wrapFrames(decls, rng.capture())); err != nil {
+					return nil, loc.error(ParseError, err)
+				}
+
+				text := rng.prefix + rangeFrame(len(decls), rng.decl, rng.body)
+				if tc.tmpl, err = p.parse(name, wrapFrames(decls, text)); err != nil {
+					return nil, loc.error(ParseError, err)
+				}
+				if tc.value, err = parseValue(name, append(decls[:len(decls):len(decls)], rng.decl), tc.tmpl, p); err != nil {
+					return nil, loc.error(ParseError, err)
+				}
+
+				if len(stack) == 0 {
+					ts.blocks = append(ts.blocks, b)
+				} else {
+					parent := stack[len(stack)-1]
+					if parent.top == r {
+						return nil, loc.error(ParseError, errors.New("nested {{range}} must start below the first row of outer one"))
+					}
+					parent.blocks = append(parent.blocks, b)
+				}
+				stack = append(stack, b)
+			}
+
+			// cell belongs to the innermost block of the row
+			if len(stack) == 0 {
+				tc.row = r
+				tc.above = lastAbove(ts.blocks, r)
+				ts.cells = append(ts.cells, tc)
+			} else {
+				b := stack[len(stack)-1]
+				tc.row = r - b.top
+				tc.above = lastAbove(b.blocks, r)
+				b.cells = append(b.cells, tc)
+			}
+		}
+
+		for ; ends > 0; ends-- {
+			if len(stack) == 0 {
+				return nil, endLoc.error(ParseError, fmt.Errorf("%s without {{range}} or {{if}}", rangeEndTag))
+			}
+			b := stack[len(stack)-1]
+			b.height = r - b.top + 1
+			stack = stack[:len(stack)-1]
+		}
+	}
+
+	if len(stack) > 0 {
+		return nil, stack[len(stack)-1].loc.error(ParseError, fmt.Errorf("block of rows without %s", rangeEndTag))
+	}
+
+	return ts, nil
+}
+
+// stackDecls returns declarations of variables of opened blocks.
+func stackDecls(stack []*tmplBlock) []string {
+	decls := make([]string, 0, len(stack))
+	for _, b := range stack {
+		decls = append(decls, b.decl)
+	}
+	return decls
+}
+
+// opensBlock reports whether the text of the cell opens a block of rows
+// what is closed by {{end.}} in the same or one of the next rows.
+func (p parser) opensBlock(name string, decls []string, val string) bool {
+
+	val = strings.Replace(val, rangeEndTag, "", -1)
+	if strings.Contains(val, colEndTag) {
+		return false
+	}
+
+	if _, err := p.parse(name, wrapFrames(decls, val)); err == nil {
+		return false
+	}
+
+	_, err := splitRange(name, decls, val+"{{end}}", p)
+	return err == nil
+}
+
+// lastAbove returns the last of closed blocks what ends above the row r.
+func lastAbove(blocks []*tmplBlock, r int) *tmplBlock {
+	for i := len(blocks) - 1; i >= 0; i-- {
+		if b := blocks[i]; b.height > 0 && b.top+b.height <= r {
+			return b
+		}
+	}
+	return nil
+}
+
+// cellName returns reference to the cell like "Sheet1!B5".
+func cellName(sheet string, r, c int) string {
+	return sheet + "!" + xlsx.GetCellIDStringFromCoords(c, r)
+}
+
+// parse parses text of the cell. In strict mode missing key of the data is
+// an error, otherwise "<no value>" is written into the report. Calls of
+// directive functions, like {{merge 2 1}}, get the render state as the
+// first argument.
+func (p parser) parse(name, text string) (*template.Template, error) {
+
+	t, err := p.newCell(name).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	edits := p.directiveCalls(t.Tree.Root, nil)
+	if len(edits) == 0 {
+		return t, nil
+	}
+
+	// правки вставляются с конца, тогда позиции остальных не меняются
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].pos < edits[j].pos })
+	for i := len(edits) - 1; i >= 0; i-- {
+		e := edits[i]
+		text = text[:e.pos] + e.text + text[e.pos:]
+	}
+
+	return p.newCell(name).Parse(text)
+}
+
+func (p parser) newCell(name string) *template.Template {
+	t := template.New(name).Funcs(p.funcs)
+	if p.strict {
+		t = t.Option("missingkey=error")
+	}
+	return t
+}
+
+// stateType is the type of the first argument of directive functions.
+var stateType = reflect.TypeOf((*renderState)(nil))
+
+// stateArg is the argument what passes the render state to directives.
+const stateArg = "$.R"
+
+// isDirective reports whether the function name is directive. Functions of
+// WithFuncs with the same names are not directives.
+func (p parser) isDirective(name string) bool {
+	fn, ok := p.funcs[name]
+	if !ok {
+		return false
+	}
+	t := reflect.TypeOf(fn)
+	return t != nil && t.Kind() == reflect.Func && t.NumIn() > 0 && t.In(0) == stateType
+}
+
+// edit is the text what is inserted into the text of the cell at pos.
+type edit struct {
+	pos  int
+	text string
+}
+
+// directiveCalls returns edits what pass the render state to calls of
+// directives in the node, so {{merge 2 1}} becomes {{merge $.R 2 1}}.
+// Calls what already get the render state are left as is.
+func (p parser) directiveCalls(node parse.Node, edits []edit) []edit {
+
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			break
+		}
+		for _, c := range n.Nodes {
+			edits = p.directiveCalls(c, edits)
+		}
+	case *parse.ActionNode:
+		edits = p.directiveCalls(n.Pipe, edits)
+	case *parse.IfNode:
+		edits = p.branchCalls(&n.BranchNode, edits)
+	case *parse.RangeNode:
+		edits = p.branchCalls(&n.BranchNode, edits)
+	case *parse.WithNode:
+		edits = p.branchCalls(&n.BranchNode, edits)
+	case *parse.TemplateNode:
+		if n.Pipe != nil {
+			edits = p.directiveCalls(n.Pipe, edits)
+		}
+	case *parse.PipeNode:
+		if n == nil {
+			break
+		}
+		for _, cmd := range n.Cmds {
+			edits = p.directiveCalls(cmd, edits)
+		}
+	case *parse.ChainNode:
+		edits = p.directiveCalls(n.Node, edits)
+	case *parse.CommandNode:
+		for i, arg := range n.Args {
+			id, ok := arg.(*parse.IdentifierNode)
+			if !ok {
+				edits = p.directiveCalls(arg, edits)
+				continue
+			}
+			if !p.isDirective(id.Ident) {
+				continue
+			}
+			end := int(id.Pos) + len(id.Ident)
+			if i > 0 {
+				// функция без аргументов в аргументе команды
+				edits = append(edits, edit{int(id.Pos), "("}, edit{end, " " + stateArg + ")"})
+			} else if !hasState(n) {
+				edits = append(edits, edit{end, " " + stateArg})
+			}
+		}
+	}
+
+	return edits
+}
+
+func (p parser) branchCalls(n *parse.BranchNode, edits []edit) []edit {
+	edits = p.directiveCalls(n.Pipe, edits)
+	edits = p.directiveCalls(n.List, edits)
+	return p.directiveCalls(n.ElseList, edits)
+}
+
+// checkCell checks text of the cell as it is written by the user, before
+// the render state is passed to directives: directives must get the number
+// of arguments they accept and the render state $.R must not be used. The
+// cell is inside of opened ranges what declare decls. Text what is not a
+// template is reported by compilation.
+func (p parser) checkCell(name string, decls []string, val string) error {
+
+	text := strings.Replace(val, colEndTag, "{{end}}", 1)
+	for k := len(decls) - 1; k >= 0; k-- {
+		text = "{{range " + decls[k] + ".}}" + text + "{{end}}"
+	}
+
+	t, err := p.newCell(name).Parse(text)
+	if err != nil {
+		// ячейка открывает блок строк
+		if t, err = p.newCell(name).Parse(text + "{{end}}"); err != nil {
+			return nil
+		}
+	}
+
+	return p.checkNode(t.Tree.Root, true)
+}
+
+// checkNode checks the node, root is set while dot is the root of data.
+func (p parser) checkNode(node parse.Node, root bool) error {
+
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			break
+		}
+		for _, c := range n.Nodes {
+			if err := p.checkNode(c, root); err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		return p.checkNode(n.Pipe, root)
+	case *parse.IfNode:
+		return p.checkBranch(&n.BranchNode, root, root)
+	case *parse.RangeNode:
+		return p.checkBranch(&n.BranchNode, root, false)
+	case *parse.WithNode:
+		return p.checkBranch(&n.BranchNode, root, false)
+	case *parse.TemplateNode:
+		if n.Pipe != nil {
+			return p.checkNode(n.Pipe, root)
+		}
+	case *parse.ChainNode:
+		return p.checkNode(n.Node, root)
+	case *parse.VariableNode:
+		if len(n.Ident) > 1 && n.Ident[0] == "$" && n.Ident[1] == "R" {
+			return errors.New("$.R is reserved for the render state")
+		}
+	case *parse.FieldNode:
+		if root && n.Ident[0] == "R" {
+			return errors.New(".R is reserved for the render state")
+		}
+	case *parse.PipeNode:
+		if n == nil {
+			break
+		}
+		for k, cmd := range n.Cmds {
+			// результат предыдущей команды конвейера - последний аргумент
+			if err := p.checkCommand(cmd, k > 0, root); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkBranch checks the branch, list is set if dot of the list is the
+// root of data.
+func (p parser) checkBranch(n *parse.BranchNode, root, list bool) error {
+	if err := p.checkNode(n.Pipe, root); err != nil {
+		return err
+	}
+	if err := p.checkNode(n.List, list); err != nil {
+		return err
+	}
+	return p.checkNode(n.ElseList, root)
+}
+
+// checkCommand checks calls of directives of the command, piped command
+// gets the result of the previous command as the last argument.
+func (p parser) checkCommand(cmd *parse.CommandNode, piped, root bool) error {
+
+	for i, arg := range cmd.Args {
+		id, ok := arg.(*parse.IdentifierNode)
+		if !ok {
+			if err := p.checkNode(arg, root); err != nil {
+				return err
+			}
+			continue
+		}
+		if !p.isDirective(id.Ident) {
+			continue
+		}
+
+		// функция в аргументе команды вызывается без аргументов
+		got := 0
+		if i == 0 {
+			got = len(cmd.Args) - 1
+			if piped {
+				got++
+			}
+		}
+
+		t := reflect.TypeOf(p.funcs[id.Ident])
+		want := t.NumIn() - 1
+		switch {
+		case t.IsVariadic() && got < want-1:
+			return fmt.Errorf("wrong number of args for %s: want at least %d got %d", id.Ident, want-1, got)
+		case !t.IsVariadic() && got != want:
+			return fmt.Errorf("wrong number of args for %s: want %d got %d", id.Ident, want, got)
+		}
+	}
+
+	return nil
+}
+
+// hasState reports whether the command passes the render state as the
+// first argument of the function.
+func hasState(cmd *parse.CommandNode) bool {
+	if len(cmd.Args) < 2 {
+		return false
+	}
+	v, ok := cmd.Args[1].(*parse.VariableNode)
+	return ok && len(v.Ident) == 2 && v.Ident[0] == "$" && v.Ident[1] == "R"
+}
+
+// cellRange is {{range}} or {{if}} what is split out of cell text. Rows of
+// {{if}} block are rendered as range of the single element, the current dot,
+// if the condition is true and are removed otherwise.
+type cellRange struct {
+	// cond is set for {{if}}
+	cond bool
+	// prefix is text of the cell before {{range}}
+	prefix string
+	// decl holds declared variables, like "$i, $v := "
+	decl string
+	// pipe is range expression without declarations
+	pipe string
+	// body is text of the cell inside of the range
+	body string
+}
+
+// capture returns text what evaluates range expression and stores
+// its value in the render state.
+func (rng cellRange) capture() string {
+	if rng.cond {
+		return "{{$.R.When (" + rng.pipe + ") .}}"
+	}
+	return capture(rng.pipe)
+}
+
+// capture returns text what evaluates the pipeline and stores its value in
+// the render state.
+func capture(pipe string) string {
+	return "{{$.R.Capture (" + pipe + ")}}"
+}
+
+// pipeText returns the pipeline without declarations.
+func pipeText(p *parse.PipeNode) string {
+	cmds := make([]string, 0, len(p.Cmds))
+	for _, cmd := range p.Cmds {
+		cmds = append(cmds, cmd.String())
+	}
+	return strings.Join(cmds, " | ")
+}
+
+// parseValue returns template what captures value of the cell what is
+// single {{pipeline}}, nil is returned for other cells. Directives of the
+// cell, like {{bold}}, do not count. The cell is inside of opened ranges
+// what declare decls.
+func parseValue(name string, decls []string, tmpl *template.Template, p parser) (*template.Template, error) {
+	pipe, dirs, ok := p.singleAction(tmpl, len(decls))
+	if !ok {
+		return nil, nil
+	}
+	return p.parse(name, wrapFrames(decls, dirs+capture(pipe)))
+}
+
+// singleAction returns the pipeline of the cell what consists of single
+// {{pipeline}} without any text around and text of directive actions of
+// the cell. The cell is inside of depth opened ranges.
+func (p parser) singleAction(t *template.Template, depth int) (string, string, bool) {
+
+	dirs := ""
+	nodes := p.skipDirectives(t.Tree.Root.Nodes, &dirs)
+	for ; depth > 0; depth-- {
+		if len(nodes) != 1 {
+			return "", "", false
+		}
+		rn, ok := nodes[0].(*parse.RangeNode)
+		if !ok || rn.List == nil {
+			return "", "", false
+		}
+		nodes = p.skipDirectives(rn.List.Nodes, &dirs)
+	}
+
+	if len(nodes) != 1 {
+		return "", "", false
+	}
+
+	an, ok := nodes[0].(*parse.ActionNode)
+	if !ok || len(an.Pipe.Decl) > 0 {
+		return "", "", false
+	}
+
+	return pipeText(an.Pipe), dirs, true
+}
+
+// skipDirectives returns nodes without actions what only call directive,
+// like {{bold}}, text of such actions is added to dirs.
+func (p parser) skipDirectives(nodes []parse.Node, dirs *string) []parse.Node {
+
+	res := make([]parse.Node, 0, len(nodes))
+	for _, n := range nodes {
+		if an, ok := n.(*parse.ActionNode); ok && len(an.Pipe.Decl) == 0 && len(an.Pipe.Cmds) == 1 {
+			if id, ok := an.Pipe.Cmds[0].Args[0].(*parse.IdentifierNode); ok && p.isDirective(id.Ident) {
+				*dirs += an.String()
+				continue
+			}
+		}
+		res = append(res, n)
+	}
+
+	return res
+}
+
+// splitRange parses text of the cell, what has to finish by {{range}}..{{end}}
+// or {{if}}..{{end}}. The cell is inside of opened ranges what declare decls.
+func splitRange(name string, decls []string, text string, p parser) (cellRange, error) {
+
+	var res cellRange
+
+	t, err := p.parse(name, wrapFrames(decls, text))
+	if err != nil {
+		return res, err
+	}
+
+	// skip ranges added by wrapFrames
+	nodes := t.Tree.Root.Nodes
+	for range decls {
+		nodes = nodes[0].(*parse.RangeNode).List.Nodes
+	}
+	if len(nodes) == 0 {
+		return res, errors.New("{{range}} or {{if}} expected")
+	}
+
+	var rn *parse.BranchNode
+	switch n := nodes[len(nodes)-1].(type) {
+	case *parse.RangeNode:
+		rn = &n.BranchNode
+	case *parse.IfNode:
+		rn = &n.BranchNode
+		res.cond = true
+	default:
+		return res, errors.New("{{range}} or {{if}} expected")
+	}
+
+	if rn.ElseList != nil {
+		return res, errors.New("{{else}} of the block of rows is not supported")
+	}
+
+	if res.cond && len(rn.Pipe.Decl) > 0 {
+		return res, errors.New("variables of {{if}} block of rows are not supported")
+	}
+
+	for _, n := range nodes[:len(nodes)-1] {
+		res.prefix += n.String()
+	}
+
+	if len(rn.Pipe.Decl) > 0 {
+		vars := make([]string, 0, len(rn.Pipe.Decl))
+		for _, v := range rn.Pipe.Decl {
+			vars = append(vars, v.String())
+		}
+		res.decl = strings.Join(vars, ", ") + " := "
+	}
+
+	res.pipe = pipeText(rn.Pipe)
+
+	if rn.List != nil {
+		res.body = rn.List.String()
+	}
+
+	return res, nil
+}
+
+// rangeFrame returns text what renders body for the current element of k-th
+// nested range. Element is kept by the render state as a map with the single
+// entry, so the range over it declares the same variables and the same dot
+// as the original {{range}}.
+func rangeFrame(k int, decl, body string) string {
+	return fmt.Sprintf("{{range %s$.R.Frame %d}}%s{{end}}", decl, k, body)
+}
+
+// wrapFrames puts text inside of the current elements of all opened ranges.
+func wrapFrames(decls []string, text string) string {
+	for k := len(decls) - 1; k >= 0; k-- {
+		text = rangeFrame(k, decls[k], text)
+	}
+	return text
+}
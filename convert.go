@@ -0,0 +1,245 @@
+package rbuilder
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Convert divides v by scale and rounds the result to decimals digits, like
+// millimeters to meters: Convert(1500, 1000, 2, RoundHalfUp) is 1.5. Values
+// are divided as decimal numbers, so the result is rounded exactly.
+func Convert(v, scale float64, decimals int, mode RoundMode) float64 {
+	if scale == 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+		return v / scale
+	}
+	r := decimalRat(v)
+	r.Quo(r, decimalRat(scale))
+	f, _ := roundRat(r, decimals, mode).Float64()
+	return f
+}
+
+// scaledFunc returns function what converts value to larger unit, like
+// {{toMeters .D.Length}} for millimeters.
+func scaledFunc(scale float64, decimals int, mode RoundMode) func(val interface{}) (float64, error) {
+	return func(val interface{}) (float64, error) {
+		f, err := toFloat(val)
+		if err != nil {
+			return 0, err
+		}
+		return Convert(f, scale, decimals, mode), nil
+	}
+}
+
+// convFunc is {{conv .D.Weight 1000 3}}: value divided by the scale and
+// rounded to the precision, optional last argument is the round mode like
+// "halfeven", def is used without it. Result is a number, so the cell stays
+// numeric.
+func convFunc(def RoundMode) func(v interface{}, scale float64, decimals int, mode ...string) (float64, error) {
+	return func(v interface{}, scale float64, decimals int, mode ...string) (float64, error) {
+
+		f, err := toFloat(v)
+		if err != nil {
+			return 0, err
+		}
+
+		if scale == 0 {
+			return 0, errors.New("conv: zero scale")
+		}
+
+		m, err := parseRoundMode(def, mode...)
+		if err != nil {
+			return 0, err
+		}
+
+		return Convert(f, scale, decimals, m), nil
+	}
+}
+
+// wordForms are forms of the noun for 1, 2 and 5 items in Russian and
+// for 1 and many items in English.
+type wordForms struct {
+	ru       [3]string
+	feminine bool
+	en       [2]string
+}
+
+// Currency describes the money unit.
+type Currency struct {
+	Code   string
+	Symbol string
+	// Minor is amount of minor units in the major one, like 100 kopecks
+	// in ruble.
+	Minor int
+	major wordForms
+	minor wordForms
+}
+
+var currencies = map[string]Currency{
+	"RUB": {
+		Code: "RUB", Symbol: "₽", Minor: 100,
+		major: wordForms{ru: [3]string{"рубль", "рубля", "рублей"}, en: [2]string{"ruble", "rubles"}},
+		minor: wordForms{ru: [3]string{"копейка", "копейки", "копеек"}, feminine: true, en: [2]string{"kopeck", "kopecks"}},
+	},
+	"USD": {
+		Code: "USD", Symbol: "$", Minor: 100,
+		major: wordForms{ru: [3]string{"доллар", "доллара", "долларов"}, en: [2]string{"dollar", "dollars"}},
+		minor: wordForms{ru: [3]string{"цент", "цента", "центов"}, en: [2]string{"cent", "cents"}},
+	},
+	"EUR": {
+		Code: "EUR", Symbol: "€", Minor: 100,
+		major: wordForms{ru: [3]string{"евро", "евро", "евро"}, en: [2]string{"euro", "euros"}},
+		minor: wordForms{ru: [3]string{"цент", "цента", "центов"}, en: [2]string{"cent", "cents"}},
+	},
+}
+
+// LookupCurrency returns the currency by ISO 4217 code, like "RUB".
+func LookupCurrency(code string) (Currency, bool) {
+	c, ok := currencies[strings.ToUpper(code)]
+	return c, ok
+}
+
+// maxWords limits amounts what are written in words, larger amounts lose
+// minor units in float64.
+const maxWords = 1e15
+
+// split returns amount of major and minor units of |v|, amount is rounded
+// to minor units.
+func (c Currency) split(v float64, mode RoundMode) (int64, int64) {
+	minor := int64(c.Minor)
+	if minor < 1 {
+		minor = 1
+	}
+	n := int64(math.Round(Round(absFloat(v), c.minorDigits(), mode) * float64(minor)))
+	return n / minor, n % minor
+}
+
+// minorDigits returns amount of digits of minor units.
+func (c Currency) minorDigits() int {
+	d := 0
+	for m := c.Minor; m > 1; m /= 10 {
+		d++
+	}
+	return d
+}
+
+func absFloat(v float64) float64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// InWords writes the amount in words, minor units are written by digits as
+// invoices do: "Две тысячи семьсот тридцать девять рублей 05 копеек".
+// lang is "ru" or "en". Amount is rounded to minor units half away from
+// zero.
+func (c Currency) InWords(lang string, v float64) (string, error) {
+	return c.inWords(lang, v, RoundHalfUp)
+}
+
+func (c Currency) inWords(lang string, v float64, mode RoundMode) (string, error) {
+
+	if !(absFloat(v) < maxWords) {
+		return "", fmt.Errorf("amount %v is too large to be written in words", v)
+	}
+
+	major, minor := c.split(v, mode)
+
+	var words, majorName, minorName string
+	switch lang {
+	case "ru":
+		words = numberWordsRU(major, false)
+		majorName = c.major.ru[pluralRU(major)]
+		minorName = c.minor.ru[pluralRU(minor)]
+		if v < 0 && (major != 0 || minor != 0) {
+			words = "минус " + words
+		}
+	case "en":
+		words = numberWordsEN(major)
+		majorName = c.major.en[pluralEN(major)]
+		minorName = c.minor.en[pluralEN(minor)]
+		if v < 0 && (major != 0 || minor != 0) {
+			words = "minus " + words
+		}
+	default:
+		return "", fmt.Errorf("unsupported language %q", lang)
+	}
+
+	res := capitalize(words) + " " + majorName
+	if d := c.minorDigits(); d > 0 {
+		res += fmt.Sprintf(" %0*d %s", d, minor, minorName)
+	}
+
+	return res, nil
+}
+
+// symbolFunc is {{symbol "RUB"}}: symbol of the currency, "₽".
+func symbolFunc(code string) (string, error) {
+	c, ok := LookupCurrency(code)
+	if !ok {
+		return "", fmt.Errorf("unknown currency %q", code)
+	}
+	return c.Symbol, nil
+}
+
+// inWordsFunc is {{inWords "ru" .D.Count}}: integer part of the number in
+// words, "Сто двадцать три".
+func inWordsFunc(lang string, v interface{}) (string, error) {
+
+	f, err := toFloat(v)
+	if err != nil {
+		return "", err
+	}
+
+	if !(absFloat(f) < maxWords) {
+		return "", fmt.Errorf("number %v is too large to be written in words", f)
+	}
+
+	n := int64(Round(absFloat(f), 0, RoundDown))
+
+	var words string
+	switch lang {
+	case "ru":
+		words = numberWordsRU(n, false)
+		if n > 0 && f < 0 {
+			words = "минус " + words
+		}
+	case "en":
+		words = numberWordsEN(n)
+		if n > 0 && f < 0 {
+			words = "minus " + words
+		}
+	default:
+		return "", fmt.Errorf("unsupported language %q", lang)
+	}
+
+	return capitalize(words), nil
+}
+
+// sumInWordsFunc is {{sumInWords "ru" "RUB" .D.Total}}: amount in words for
+// invoices, сумма прописью. Amount is rounded to minor units by mode.
+func sumInWordsFunc(mode RoundMode) func(lang, code string, v interface{}) (string, error) {
+	return func(lang, code string, v interface{}) (string, error) {
+
+		c, ok := LookupCurrency(code)
+		if !ok {
+			return "", fmt.Errorf("unknown currency %q", code)
+		}
+
+		f, err := toFloat(v)
+		if err != nil {
+			return "", err
+		}
+
+		return c.inWords(lang, f, mode)
+	}
+}
+
+func capitalize(s string) string {
+	for i, r := range s {
+		return strings.ToUpper(string(r)) + s[i+len(string(r)):]
+	}
+	return s
+}
@@ -0,0 +1,99 @@
+package rbuilder
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tealeg/xlsx"
+)
+
+// ErrorKind tells at which stage template cell has failed.
+type ErrorKind int
+
+const (
+	// ParseError means the cell text is not valid template.
+	ParseError ErrorKind = iota + 1
+	// ExecError means placeholder of the cell failed on the data.
+	ExecError
+	// MissingKeyError means placeholder refers to the key or the field
+	// what data does not have.
+	MissingKeyError
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ParseError:
+		return "parse error"
+	case ExecError:
+		return "exec error"
+	case MissingKeyError:
+		return "missing key"
+	}
+	return fmt.Sprintf("ErrorKind(%d)", int(k))
+}
+
+// CellError is returned by Compile and Render when template cell fails.
+// It points at the cell of the template what should be fixed.
+type CellError struct {
+	Kind  ErrorKind
+	Sheet string
+	// Row and Col are zero based coordinates of the cell in the template.
+	Row int
+	Col int
+	// Cell is A1 reference of the cell, like "B5".
+	Cell string
+	// Text is the original text of the cell.
+	Text string
+	Err  error
+}
+
+func (e *CellError) Error() string {
+	return fmt.Sprintf("%s!%s %q: %s: %v", e.Sheet, e.Cell, e.Text, e.Kind, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *CellError) Unwrap() error {
+	return e.Err
+}
+
+// location is the place of the cell in the template.
+type location struct {
+	sheet string
+	row   int
+	col   int
+	text  string
+}
+
+// error wraps err into CellError of the cell. Error what is already
+// CellError is returned as is.
+func (l location) error(kind ErrorKind, err error) error {
+
+	if ce, ok := err.(*CellError); ok {
+		return ce
+	}
+
+	// text/template сообщает об отсутствующем ключе map только
+	// текстом ошибки
+	if kind == ExecError {
+		msg := err.Error()
+		if strings.Contains(msg, "map has no entry for key") || strings.Contains(msg, "can't evaluate field") {
+			kind = MissingKeyError
+		}
+		// состояние, переданное директивам, не показывается, например
+		// <merge $.R 0 1> выводится как в ячейке <merge 0 1>
+		if strings.Contains(msg, " "+stateArg) {
+			err = errors.New(strings.Replace(msg, " "+stateArg, "", -1))
+		}
+	}
+
+	return &CellError{
+		Kind:  kind,
+		Sheet: l.sheet,
+		Row:   l.row,
+		Col:   l.col,
+		Cell:  xlsx.GetCellIDStringFromCoords(l.col, l.row),
+		Text:  l.text,
+		Err:   err,
+	}
+}
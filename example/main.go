@@ -7,8 +7,6 @@ import (
 	"os"
 	"time"
 
-	"strings"
-
 	"github.com/regorov/rbuilder"
 	"github.com/tealeg/xlsx"
 )
@@ -36,7 +34,7 @@ func main() {
 		"CompanyName": "ООО \"Элефант софт\" г.Казань",
 		"CurrentTime": time.Now().Format("02.01.2006 15:04:05")}
 
-	rbt := rbuilder.NewTemplate(tmpl, s)
+	rbt := rbuilder.NewTemplate(tmpl, s, rbuilder.WithAutoFitRows())
 
 	fmt.Println(string(buf))
 
@@ -56,8 +54,6 @@ func main() {
 		os.Exit(3)
 	}
 
-	mergeCells(result)
-
 	err = result.Save(os.Args[3])
 	if err != nil {
 		fmt.Println(err)
@@ -65,55 +61,3 @@ func main() {
 	}
 
 }
-
-func mergeCells(report *xlsx.File) {
-
-	br, bc := 0, 0
-	b := false
-	for s := range report.Sheets {
-		for r := range report.Sheets[s].Rows {
-			for c := range report.Sheets[s].Rows[r].Cells {
-				val := report.Sheets[s].Rows[r].Cells[c].Value
-
-				if b == false {
-					if strings.Index(val, "<<") != 0 {
-						continue
-					}
-					br, bc, b = r, c, true
-					report.Sheets[s].Rows[r].Cells[c].Value = val[2:]
-
-					continue
-				}
-
-				// сюда попадает только если найдено начало требования
-				// по объединению ячеек
-
-				if !strings.Contains(val, ">>") {
-					continue
-				}
-				println("<< found", s, r, c)
-
-				// сюда попадает, если найдено требование окончания
-				// сегмента по объединению ячеек
-
-				//if left {
-				report.Sheets[s].Rows[br].Cells[bc].Merge(c-bc, r-br)
-
-				/*} else {
-				val := report.Sheets[s].Rows[r].Cells[c].Value
-
-				report.Sheets[s].Rows[br].Cells[bc].Merge(c-bc, r-br)
-				report.Sheets[s].Rows[br].Cells[bc]
-
-				/*st := report.Sheets[s].Rows[br].Cells[bc].GetStyle()
-				fmt.Printf("%v", st)
-				st.Alignment.Horizontal = "right"
-				report.Sheets[s].Rows[br].Cells[bc].SetStyle(st)*/
-				//}
-
-				b = false
-
-			}
-		}
-	}
-}
@@ -0,0 +1,254 @@
+package rbuilder
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+)
+
+// Locale describes how numbers, amounts and dates are written. Zero Locale
+// writes numbers as strconv does and recognises only such numbers.
+type Locale struct {
+	// Decimal separates fractional part of the number, "." if empty.
+	Decimal string
+	// Group separates thousands, numbers are not grouped if empty. Space
+	// separator matches any of space, non-breaking space and narrow
+	// non-breaking space.
+	Group string
+	// DateFormat is the layout of time.Format, "2006-01-02" if empty.
+	DateFormat string
+	// Currency is symbol of the currency, CurrencyAfter puts it after
+	// the amount.
+	Currency      string
+	CurrencyAfter bool
+}
+
+var (
+	// LocaleRU writes 1 234 567,89 ₽ and 02.01.2006.
+	LocaleRU = Locale{Decimal: ",", Group: "\u00a0", DateFormat: "02.01.2006", Currency: "₽", CurrencyAfter: true}
+	// LocaleEN writes $1,234,567.89 and 01/02/2006.
+	LocaleEN = Locale{Decimal: ".", Group: ",", DateFormat: "01/02/2006", Currency: "$"}
+)
+
+// разделители разрядов, которые считаются пробелом
+var spaces = []string{" ", "\u00a0", "\u202f"}
+
+func (l Locale) decimal() string {
+	if l.Decimal == "" {
+		return "."
+	}
+	return l.Decimal
+}
+
+// spaceGroup tells if thousands are separated by some kind of space.
+func (l Locale) spaceGroup() bool {
+	for _, r := range l.Group {
+		return unicode.IsSpace(r)
+	}
+	return false
+}
+
+// ParseNumber recognises number written in the locale, like "2 739,00" in
+// LocaleRU. Thousands must be grouped by three digits.
+func (l Locale) ParseNumber(s string) (float64, bool) {
+
+	if l.Decimal == "" && l.Group == "" {
+		return 0, false
+	}
+
+	s = strings.TrimSpace(s)
+
+	sign := ""
+	switch {
+	case strings.HasPrefix(s, "-"), strings.HasPrefix(s, "+"):
+		sign, s = s[:1], s[1:]
+	case strings.HasPrefix(s, "−"):
+		// знак минус типографского набора
+		sign, s = "-", s[len("−"):]
+	}
+
+	intPart, frac := s, ""
+	if i := strings.LastIndex(s, l.decimal()); i >= 0 {
+		intPart, frac = s[:i], s[i+len(l.decimal()):]
+		if !isDigits(frac) {
+			return 0, false
+		}
+	}
+
+	if l.Group != "" {
+		if l.spaceGroup() {
+			for _, sp := range spaces {
+				intPart = strings.Replace(intPart, sp, l.Group, -1)
+			}
+		}
+		groups := strings.Split(intPart, l.Group)
+		if len(groups) > 1 {
+			if len(groups[0]) > 3 {
+				return 0, false
+			}
+			for _, g := range groups[1:] {
+				if len(g) != 3 {
+					return 0, false
+				}
+			}
+			intPart = strings.Join(groups, "")
+		}
+	}
+
+	if !isDigits(intPart) {
+		return 0, false
+	}
+
+	if frac != "" {
+		intPart += "." + frac
+	}
+
+	v, err := strconv.ParseFloat(sign+intPart, 64)
+	return v, err == nil
+}
+
+// isDigits tells if s is not empty and has only ASCII digits.
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// FormatNumber writes the number with decimals digits after the separator
+// and grouped thousands. Number is rounded half away from zero.
+func (l Locale) FormatNumber(v float64, decimals int) string {
+
+	if decimals < 0 {
+		decimals = 0
+	}
+
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		return strconv.FormatFloat(v, 'f', decimals, 64)
+	}
+
+	s := strconv.FormatFloat(Round(math.Abs(v), decimals, RoundHalfUp), 'f', decimals, 64)
+
+	intPart, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, frac = s[:i], s[i+1:]
+	}
+
+	var b strings.Builder
+	if v < 0 && strings.Trim(s, "0.") != "" {
+		b.WriteString("-")
+	}
+
+	for i := 0; i < len(intPart); i++ {
+		if i > 0 && (len(intPart)-i)%3 == 0 {
+			b.WriteString(l.Group)
+		}
+		b.WriteByte(intPart[i])
+	}
+
+	if frac != "" {
+		b.WriteString(l.decimal())
+		b.WriteString(frac)
+	}
+
+	return b.String()
+}
+
+// FormatMoney writes the amount with the currency symbol of the locale.
+func (l Locale) FormatMoney(v float64, decimals int) string {
+
+	n := l.FormatNumber(v, decimals)
+
+	switch {
+	case l.Currency == "":
+		return n
+	case l.CurrencyAfter:
+		return n + "\u00a0" + l.Currency
+	case strings.HasPrefix(n, "-"):
+		return "-" + l.Currency + n[1:]
+	}
+
+	return l.Currency + n
+}
+
+// FormatDate writes the date in the format of the locale.
+func (l Locale) FormatDate(t time.Time) string {
+	if l.DateFormat == "" {
+		return t.Format("2006-01-02")
+	}
+	return t.Format(l.DateFormat)
+}
+
+// funcs returns template functions what write values in the locale,
+// numbers are rounded by mode.
+func (l Locale) funcs(mode RoundMode) template.FuncMap {
+	return template.FuncMap{
+		"fnum": func(decimals int, v interface{}) (string, error) {
+			f, err := toFloat(v)
+			if err != nil {
+				return "", err
+			}
+			return l.FormatNumber(Round(f, decimals, mode), decimals), nil
+		},
+		"fmoney": func(decimals int, v interface{}) (string, error) {
+			f, err := toFloat(v)
+			if err != nil {
+				return "", err
+			}
+			return l.FormatMoney(Round(f, decimals, mode), decimals), nil
+		},
+		"fcur": func(code string, decimals int, v interface{}) (string, error) {
+			c, ok := LookupCurrency(code)
+			if !ok {
+				return "", fmt.Errorf("unknown currency %q", code)
+			}
+			f, err := toFloat(v)
+			if err != nil {
+				return "", err
+			}
+			cl := l
+			cl.Currency = c.Symbol
+			return cl.FormatMoney(Round(f, decimals, mode), decimals), nil
+		},
+		"fdateloc": l.FormatDate,
+	}
+}
+
+// toFloat converts number or string with number to float64.
+func toFloat(v interface{}) (float64, error) {
+
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return 0, fmt.Errorf("number expected, got %v", v)
+		}
+		rv = rv.Elem()
+	}
+
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	case reflect.String:
+		f, err := strconv.ParseFloat(strings.TrimSpace(rv.String()), 64)
+		if err != nil {
+			return 0, fmt.Errorf("number expected, got %q", rv.String())
+		}
+		return f, nil
+	}
+
+	return 0, fmt.Errorf("number expected, got %T", v)
+}
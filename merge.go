@@ -0,0 +1,143 @@
+package rbuilder
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tealeg/xlsx"
+)
+
+// Директивы ячейки получают состояние рендеринга первым аргументом, parser
+// добавляет его к вызовам директив в тексте шаблона. Директивы сохраняются в
+// состоянии и применяются при записи значения ячейки, поэтому данные,
+// выведенные в ячейку, не могут задать директиву.
+
+const (
+	mergeDirective     = "merge"
+	mergeSameDirective = "mergeSame"
+	formulaDirective   = "formula"
+)
+
+// directive is the change of the cell what is made by the directive
+// function, like {{merge 2 1}}.
+type directive struct {
+	name string
+	args []string
+}
+
+// mergeFunc is {{merge w h}}: the cell is merged with cells to the right and
+// below, so merged region is w columns wide and h rows high.
+func mergeFunc(st *renderState, w, h int) (string, error) {
+	if w < 1 || h < 1 {
+		return "", fmt.Errorf("merge: invalid size %dx%d", w, h)
+	}
+	st.directive(mergeDirective, strconv.Itoa(w), strconv.Itoa(h))
+	return "", nil
+}
+
+// mergeSameFunc is {{mergeSame}}: after rendering, the cell is merged with
+// the cells below in the same column what have the same value and
+// {{mergeSame}} too.
+func mergeSameFunc(st *renderState) string {
+	st.directive(mergeSameDirective)
+	return ""
+}
+
+// applyDirectives applies directives of the cell. written is set if the
+// directive has written the cell itself, so rendered text is not needed.
+func (rr *renderer) applyDirectives(cell *xlsx.Cell, dirs []directive) (written bool, err error) {
+
+	// изменения стиля применяются к ячейке одной копией стиля
+	var styles []string
+
+	for _, d := range dirs {
+		switch d.name {
+		case mergeDirective:
+			if len(d.args) != 2 {
+				return false, errors.New("invalid merge directive")
+			}
+			w, _ := strconv.Atoi(d.args[0])
+			h, _ := strconv.Atoi(d.args[1])
+			cell.HMerge = w - 1
+			cell.VMerge = h - 1
+		case mergeSameDirective:
+			if rr.same == nil {
+				rr.same = make(map[*xlsx.Cell]bool)
+			}
+			rr.same[cell] = true
+		case formulaDirective:
+			rr.setFormula(cell, d.args[0])
+			written = true
+		case totalDirective:
+			if err := rr.setTotal(cell, d.args); err != nil {
+				return false, err
+			}
+			written = true
+		case styleDirective:
+			styles = append(styles, strings.Join(d.args, ":"))
+		default:
+			return false, fmt.Errorf("unknown directive %q", d.name)
+		}
+	}
+
+	if len(styles) > 0 {
+		if err := rr.restyle(cell, styles); err != nil {
+			return false, err
+		}
+	}
+
+	return written, nil
+}
+
+// mergeSame merges vertical runs of cells with {{mergeSame}} what have the
+// same value. Value is kept by the top cell of the run.
+func (rr *renderer) mergeSame() {
+
+	if len(rr.same) == 0 {
+		return
+	}
+
+	// значения объединенных ячеек очищаются после поиска всех серий
+	var merged []*xlsx.Cell
+
+	for _, sheet := range rr.report.Sheets {
+		for r := 0; r < len(sheet.Rows); r++ {
+			for c, cell := range sheet.Rows[r].Cells {
+				if !rr.same[cell] {
+					continue
+				}
+
+				// начало серии уже объединено с ячейкой выше
+				if r > 0 && c < len(sheet.Rows[r-1].Cells) {
+					if up := sheet.Rows[r-1].Cells[c]; rr.same[up] && up.Value == cell.Value {
+						continue
+					}
+				}
+
+				n := 0
+				for k := r + 1; k < len(sheet.Rows) && c < len(sheet.Rows[k].Cells); k++ {
+					next := sheet.Rows[k].Cells[c]
+					if !rr.same[next] || next.Value != cell.Value {
+						break
+					}
+					n++
+				}
+
+				if n == 0 {
+					continue
+				}
+
+				cell.VMerge = n
+				for k := r + 1; k <= r+n; k++ {
+					merged = append(merged, sheet.Rows[k].Cells[c])
+				}
+			}
+		}
+	}
+
+	for _, cell := range merged {
+		cell.SetString("")
+	}
+}
@@ -0,0 +1,86 @@
+package rbuilder
+
+import "text/template"
+
+// Option configures Template.
+type Option func(*Template)
+
+// Logger receives leveled render tracing. Message is followed by key-value
+// pairs, so *slog.Logger can be passed as is. Debug traces expansion of
+// blocks, Info reports finished rendering, Warn reports parts of the
+// template what are lost, like auto filter of deleted rows, and Error
+// reports failed compilation or rendering.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// WithLogger sets logger of rendering. Template is silent by default.
+func WithLogger(l Logger) Option {
+	return func(t *Template) {
+		if l == nil {
+			l = nopLogger{}
+		}
+		t.logger = l
+	}
+}
+
+// nopLogger discards everything.
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...interface{}) {}
+func (nopLogger) Info(msg string, args ...interface{})  {}
+func (nopLogger) Warn(msg string, args ...interface{})  {}
+func (nopLogger) Error(msg string, args ...interface{}) {}
+
+// WithLocale sets locale of the template. Rendered text written in the
+// locale, like "2 739,00" in LocaleRU, becomes a number, and fnum, fmoney
+// and fdateloc functions write values in the locale.
+func WithLocale(l Locale) Option {
+	return func(t *Template) {
+		t.locale = l
+	}
+}
+
+// WithFuncs adds functions to placeholders of the template. Functions with
+// the names of built-in ones, like toRubles, replace them.
+func WithFuncs(funcs template.FuncMap) Option {
+	return func(t *Template) {
+		if t.userFuncs == nil {
+			t.userFuncs = make(template.FuncMap, len(funcs))
+		}
+		for name, fn := range funcs {
+			t.userFuncs[name] = fn
+		}
+	}
+}
+
+// WithRoundMode sets how numeric functions of placeholders round values,
+// RoundHalfUp by default.
+func WithRoundMode(m RoundMode) Option {
+	return func(t *Template) {
+		t.round = m
+	}
+}
+
+// WithAutoFitRows makes rows of {{range}} elements high enough for their
+// wrapped text. Height is estimated from the text length, column width and
+// font size of cells with "Wrap text" alignment, rows are not made lower
+// than in the template.
+func WithAutoFitRows() Option {
+	return func(t *Template) {
+		t.autoFit = true
+	}
+}
+
+// WithStrictKeys makes the key what map of the data does not have an error
+// of the cell, CellError of MissingKeyError kind. By default such
+// placeholder writes "<no value>". Missing field of the struct is always
+// an error.
+func WithStrictKeys() Option {
+	return func(t *Template) {
+		t.strictKeys = true
+	}
+}
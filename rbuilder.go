@@ -1,780 +1,1256 @@
-package rbuilder
-
-import (
-	"bytes"
-	"errors"
-	"fmt"
-	"strconv"
-	"strings"
-	"time"
-
-	"text/template"
-
-	"github.com/tealeg/xlsx"
-)
-
-const debug bool = true
-
-type Template struct {
-	*xlsx.File
-	staticData interface{}
-}
-
-func NewTemplate(tmpl *xlsx.File, staticData interface{}) Template {
-	return Template{File: tmpl, staticData: staticData}
-}
-
-func AwayFromZero(v float64, decimals int) float64 {
-	var pow float64 = 1
-	for i := 0; i < decimals; i++ {
-		pow *= 10
-	}
-	if v < 0 {
-		return float64(int((v*pow)-0.5)) / pow
-	}
-	return float64(int((v*pow)+0.5)) / pow
-}
-
-var funcMap = template.FuncMap{
-
-	"fdate": func(s string, t time.Time) string { return t.Format(s) },
-	"nfmt": func(val int, base int) float64 {
-		return float64(val) / float64(base)
-	},
-	"toMeters": func(val int) string {
-		return fmt.Sprintf("%0.2f", AwayFromZero(float64(val)/1000.00, 2))
-	},
-	"toTonnes": func(val int) string {
-		return fmt.Sprintf("%0.3f", AwayFromZero(float64(val)/1000.00, 3))
-	},
-	"toKMeters": func(val int) string {
-		return fmt.Sprintf("%0.3f", AwayFromZero(float64(val)/1000000.00, 3))
-	},
-	"toRubles": func(val int) string {
-		return fmt.Sprintf("%0.2f", AwayFromZero(float64(val)/100.00, 2))
-	},
-}
-
-// Render generates report based on template. Returns new object xlsx what
-// inherits template with values instead of text/template placeholders.
-func (t *Template) Render(data interface{}) (*xlsx.File, error) {
-
-	// create template copy
-	buf := bytes.NewBuffer(nil)
-	err := t.Write(buf)
-	if err != nil {
-		return nil, err
-	}
-
-	result, err := xlsx.OpenBinary(buf.Bytes())
-	if err != nil {
-		return nil, err
-	}
-
-	// render static template values {{.Attr}}, what does not
-	// change amount of lines in result file
-	err = t.renderStatic(result, data)
-	if err != nil {
-		return nil, err
-	}
-
-	// render {{range }}{{end}} what changes amount of line.
-	err = t.renderRange(result, data)
-
-	return result, err
-}
-
-func (t *Template) renderRange(report *xlsx.File, data interface{}) error {
-
-	// collects information about rows/cells what are part of {{range}}{{end.}}
-	tags := ""
-	for s := range report.Sheets {
-		for r := range report.Sheets[s].Rows {
-		rows:
-			for c := range report.Sheets[s].Rows[r].Cells {
-				val := report.Sheets[s].Rows[r].Cells[c].Value
-				if strings.Contains(val, "{{") && strings.Contains(val, "}}") {
-
-					if strings.Contains(val, "range") {
-						// добавляем заголовок блока range
-						tags = tags + fmt.Sprintf("##begin:%d/%d%s", s, r, tagSeparator)
-					}
-
-					if strings.Contains(val, "{{end.}}") {
-						val = strings.Replace(val, "{{end.}}", "", 1)
-						if len(val) > 0 {
-							// если в ячейке есть какие то другие данные кроме тэга {{end}}
-							tags += fmt.Sprintf("%s<<%d>>", val, c)
-						}
-
-						tags += tagSeparator + "{{end}}##end" + tagSeparator
-
-						break rows
-					}
-					tags = tags + fmt.Sprintf("%s<<%d>>", val, c)
-
-				}
-
-			}
-		}
-	}
-
-	// Done. variable tags holds information about ranges.
-
-	debugf("%s\n", tags)
-
-	// пропускаем выделенные тэги через шаблонизатор.
-	tmp := template.Must(template.New("report").Funcs(funcMap).Parse(tags))
-
-	buf := bytes.NewBuffer(nil)
-
-	err := tmp.Execute(buf, struct {
-		D interface{}
-		S interface{}
-	}{data, t.staticData})
-	if err != nil {
-		return err
-	}
-
-	// lines содержит один или несколько блоков ##begin:N.... ##end разбитые по строкам.
-	// строки между блоками ##begin:N...##end содержит строки, которые необходимо вставить
-	// вместо строки где встретился {{range}}...{{end}}
-	lines := strings.Split(buf.String(), tagSeparator)
-
-	if debug {
-		for i := range lines {
-			debugf("%s\n", lines[i])
-		}
-	}
-
-	// теперь необходимо, заменить одну строку содержащую {{range}}..{{end}}
-	// несколькими аналогичными строками, в которые затем будут вписанные данные
-	// из lines. Для этого используется содержимое lines, а именно кол-во строк
-	// между строками обозначающими начало и конец блока ##begin:N... ##end
-
-	i := 0
-	offset := make(map[int]int, 0)
-	for ; i < len(lines); i++ {
-
-		debugf("%s\n", lines[i])
-		if !strings.HasPrefix(lines[i], "##begin:") {
-			continue
-		}
-
-		// найдено начало блока ##begin:N
-		// rangeRowNum хранит номер листа/строки из шаблона где находится {{range}}...{{end}}
-
-		tmp := strings.Split(lines[i][8:], "/")
-
-		// в s номер листа
-		s, err := strconv.Atoi(tmp[0])
-		if err != nil {
-			return err
-		}
-
-		// в rangeRowNum номер строки
-		rangeRowNum, err := strconv.Atoi(tmp[1])
-		if err != nil {
-			return err
-		}
-
-		rangeRowNum += offset[s]
-
-		// теперь двигаемся до ближайшей строки ##end
-		// cnt - количество строк в блоке в результате генерации блока {{range}}{{end}}
-		// Внимание: предполагается, что ##end будет обязательно, ведь иначе
-		// при генерации шаблона будет ошибка, если не встретится {{end}}
-		cnt := 0
-		for j := i + 1; j < len(lines); j++ {
-			if strings.HasPrefix(lines[j], "##end") {
-				cnt = j - i - 1
-				break
-			}
-		}
-
-		if cnt == 0 {
-			// если генерация {{range}}{{end}} дала ноль записей, то есть после
-			// строчки ##begin:N следующей сразу ##end, тогда необходимо из формируемого excel файла
-			// удалить строчку содержащую тэги {{range}}{{end}}
-			debugf("del row: %d, offset:%d\n", rangeRowNum, offset[s])
-			// значит надо удалить строчку с {{range}}
-			err = delRow(report, 0, rangeRowNum+offset[s])
-			if err != nil {
-				return err
-			}
-			offset[s]--
-
-			// переходим к обработке следующего блока ##begin:N...##end
-			continue
-		}
-
-		debugf("amount of rows to insert %d\n", cnt)
-
-		// если количество строк которые сформированы шаблонизатором для
-		// {{range}}{{end}} больше нуля, то копируем все строки до начала
-		// строки {{range}}{{end}}, потому что если не будет данных
-		// нам не надо создавать пустую строчку без данных
-		if err := insertRows(report, report.Sheets[s], rangeRowNum+offset[s], cnt-1, report.Sheets[s].Rows[rangeRowNum+offset[s]]); err != nil {
-			return err
-		}
-
-		offset[s] += cnt - 1
-
-		// теперь необходимо в каждой вставленной строке, заменить ячейки
-		// данными которые находятся между ##begin:N...##end
-		// сейчас мы находимся
-
-		l := 0
-		for k := i + 1; k < i+1+cnt; k++ {
-			// k - индекс в массиве lines между строками ##begin и ##end
-			cval := parseRangeLine(lines[k])
-			fmt.Printf("%v, rangeRowNum=%d\n", cval, rangeRowNum)
-
-			for c, str := range cval {
-				setValue(report, s, rangeRowNum+l, c, str)
-			}
-			l++
-
-		}
-		// первую строку надо пропустить, там будет ##begin:N
-
-		/*		// двигаемся до конца сгенерированного блока
-				i++
-				for ; i < len(lines); i++ {
-					if strings.HasPrefix(lines[i], "##end") {
-
-						break
-					}
-					// если есть строка которую надо добавить как результат range
-					// добавляем одну строку
-					debugf("append table row: %d\n", i)
-					/*				if err := appendRows(report, result, 0, rangeRowNum, rangeRowNum+1, 0); err != nil {
-
-									return nil, err
-								}*/
-
-		// надо ее распарсить и присворить значениям новой добавленной строки
-		//}
-
-	}
-
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-const tagSeparator = "$$^~^$$"
-
-func (t *Template) renderStatic(report *xlsx.File, data interface{}) error {
-
-	// tags holds all static values what does not part of
-	// {{range}}{{end}} block
-	// at the moment supported only single row {{range}}..{{end}}
-	// what covers whole row
-	tags := ""
-
-	if len(report.Sheets) == 0 {
-		return errors.New("report has not scheets")
-	}
-	for s := range report.Sheets {
-		for r := range report.Sheets[s].Rows {
-		rows:
-			for c := range report.Sheets[s].Rows[r].Cells {
-				val := report.Sheets[s].Rows[r].Cells[c].Value
-				if !(strings.Contains(val, "{{") && strings.Contains(val, "}}")) {
-					continue
-				}
-				println("static cell format: r, c, type", r, c, report.Sheets[s].Cell(r, c).Type())
-
-				if strings.Contains(val, "range") {
-					debugf("range found: %d:%d:%d\n", s, r, c)
-					break rows
-				}
-
-				tags = tags + fmt.Sprintf("##%d:%d:%d##%s%s", s, r, c, val, tagSeparator)
-
-			}
-		}
-	}
-
-	debugf("Static tags positions:\n %s", tags)
-
-	tmp := template.Must(template.New("report").Funcs(funcMap).Parse(tags))
-
-	buf := bytes.NewBuffer(nil)
-
-	err := tmp.Execute(buf, struct {
-		D interface{}
-		S interface{}
-	}{data, t.staticData})
-	if err != nil {
-		return err
-	}
-
-	lines := strings.Split(buf.String(), tagSeparator)
-	for _, line := range lines {
-		debugf("extracting parsing results: %s\n", line)
-		if !strings.HasPrefix(line, "##") {
-			continue
-		}
-
-		line = line[2:]
-		closeIdx := strings.Index(line, "##")
-		if closeIdx < 0 {
-			return errors.New("fatal error: not found closing ##")
-		}
-
-		s, r, c, err := extractSRC(line[:closeIdx])
-		if err != nil {
-			return err
-		}
-
-		str := line[closeIdx+2:] //##0:1:1##Привет {{.Name}}
-
-		println("Cell params: r, c, type", r, c, report.Sheets[s].Cell(r, c).Type())
-
-		_ = setValue(report, s, r, c, str)
-
-		/*
-			//style := report.Sheets[0].Cell(r, c).Set
-			cellType := report.Sheets[0].Cell(r, c).Type()
-			//println("format", format)
-			if cellType == xlsx.CellTypeNumeric {
-				fval, err := strconv.ParseFloat(val, 10)
-				if err != nil {
-					return err
-				}
-			} else {
-
-			}
-		*/
-		//
-	}
-
-	return nil
-}
-
-func setValue(report *xlsx.File, s, r, c int, str string) error {
-
-	numberFormat := report.Sheets[s].Cell(r, c).GetNumberFormat()
-	println("cell format: ", numberFormat)
-
-	if numberFormat == "@" {
-		report.Sheets[s].Cell(r, c).SetString(str)
-		return nil
-	}
-
-	if val, err := strconv.ParseFloat(str, 10); err == nil {
-		report.Sheets[s].Cell(r, c).SetFloat(val)
-		report.Sheets[s].Cell(r, c).NumFmt = numberFormat
-		return nil
-	}
-
-	if val, err := strconv.ParseInt(str, 10, 64); err == nil {
-		report.Sheets[s].Cell(r, c).SetInt64(val)
-		report.Sheets[s].Cell(r, c).NumFmt = numberFormat
-		return nil
-	}
-
-	if report.Sheets[s].Cell(r, c).Type() == xlsx.CellTypeDate {
-		println("date type cell")
-		//report.Sheets[0].Cell(r, c).SetDate(time.Now())
-		return nil
-	}
-
-	report.Sheets[s].Cell(r, c).SetString(str)
-
-	return nil
-}
-
-func parseRangeLine(s string) map[int]string {
-
-	m := make(map[int]string)
-	p := 0
-	println("parseRangeLine(", s, ")")
-
-	for {
-		ib := strings.Index(s, "<<")
-		if ib < 0 {
-			// больше нет
-			break
-		}
-
-		ie := strings.Index(s, ">>")
-
-		println("<<", s[ib+2:ie], ">>")
-		c, err := strconv.Atoi(s[ib+2 : ie])
-		if err != nil {
-			panic(err)
-		}
-
-		m[c] = s[:ib]
-
-		s = s[ie+2:]
-
-		p++
-	}
-
-	return m
-}
-
-// extractSRC takes string like "1:4:5" and extracts values
-func extractSRC(str string) (s, r, c int, err error) {
-
-	val := strings.SplitN(str, ":", 3)
-	if len(val) != 3 {
-		err = errors.New("invalid input! Expected line look like \"1:2:5\"")
-		return
-	}
-
-	s, err = strconv.Atoi(val[0])
-	if err != nil {
-		return
-	}
-
-	r, err = strconv.Atoi(val[1])
-	if err != nil {
-		return
-	}
-
-	c, err = strconv.Atoi(val[2])
-	if err != nil {
-		return
-	}
-
-	return
-}
-
-func debugf(s string, args ...interface{}) {
-	if debug {
-		fmt.Printf(s, args...)
-	}
-}
-
-func appendRows(from, to *xlsx.File, fromS, fromR, toR, toS int) error {
-
-	if from == nil {
-		return errors.New("invalid source file")
-	}
-
-	if to == nil {
-		return errors.New("invalid target file")
-	}
-
-	if fromS >= len(from.Sheets) {
-		return errors.New("invalid scheet number from")
-	}
-
-	if toS >= len(to.Sheets) {
-		return errors.New("invalid scheet number to")
-	}
-
-	if fromR >= len(from.Sheets[fromS].Rows) {
-		return errors.New("invalid starting row in source scheet")
-	}
-
-	if toR >= len(from.Sheets[fromS].Rows) {
-		return errors.New("invalid ending row in source scheet")
-	}
-	/*
-		for i := fromR; i <= toR; i++ {
-			row := to.Sheets[toS].AddRow()
-			for _, c := range from.Sheets[fromS].Rows[i].Cells {
-				cell := row.AddCell()
-				cell.SetStyle(c.GetStyle())
-				cell.SetValue(c.Value)
-			}
-		}
-	*/
-
-	for i := fromR; i <= toR; i++ {
-		(*to).Sheets[toS].Rows = append((*to).Sheets[toS].Rows, from.Sheets[fromS].Rows[i])
-	}
-	for i := range to.Sheets[toS].Rows {
-		(*to).Sheets[toS].Rows[i].Sheet = to.Sheets[toS]
-	}
-
-	buf := bytes.NewBuffer(nil)
-	if err := to.Write(buf); err != nil {
-		return err
-	}
-
-	to1, err := xlsx.OpenBinary(buf.Bytes())
-	if err != nil {
-		return err
-	}
-
-	*to = *to1
-
-	return nil
-}
-
-func delRow(f *xlsx.File, s, r int) error {
-
-	if f == nil {
-		return errors.New("invalid file")
-	}
-
-	if s >= len(f.Sheets) {
-		return errors.New("invalid scheet number")
-	}
-
-	if r >= len(f.Sheets[s].Rows) {
-		return errors.New("invalid row in scheet")
-	}
-
-	(*f).Sheets[s].Rows = append(f.Sheets[s].Rows[0:r], append([]*xlsx.Row{}, (*f).Sheets[s].Rows[r+1:]...)...)
-
-	return nil
-}
-
-func insertRowsOld(f *xlsx.File, toS, startR, cnt int, row *xlsx.Row) error {
-
-	if f == nil {
-		return errors.New("invalid file")
-	}
-
-	if row == nil {
-		return errors.New("invalid row")
-	}
-
-	if toS >= len(f.Sheets) {
-		return errors.New("invalid scheet number")
-	}
-
-	if startR >= len(f.Sheets[toS].Rows) {
-		return errors.New("invalid starting row in scheet")
-	}
-
-	// делаем глубокое копирование строк. То есть создаем несколько глубоких копий
-	// row в количестве cnt.
-
-	nrows := make([]xlsx.Row, 0)
-	for i := 0; i < cnt; i++ {
-
-		nrows = append(nrows, *row)
-		nrow := &nrows[len(nrows)-1]
-		nrow.Sheet = f.Sheets[toS]
-		nrow.Cells = nil
-
-		for c := range row.Cells {
-			println("row", i, "cell", c, "Cell.style.NamedStyleIndex", row.Cells[c].GetStyle().NamedStyleIndex)
-			cell := nrow.AddCell()
-			//style := new(xlsx.Style)
-			*cell = *row.Cells[c]
-			//*style = *from.Rows[i].Cells[c].GetStyle()
-			cell.Row = nrow
-			//cell.SetStyle(style)
-			nrow.Cells = append(nrow.Cells, cell)
-
-		}
-
-		// (*f).Sheets[toS].Rows = append(f.Sheets[toS].Rows[0:startR], append([]*xlsx.Row{nrow}, (*f).Sheets[toS].Rows[startR:]...)...)
-	}
-
-	/*for i := 0; i < cnt; i++ {
-
-		nrow := new(xlsx.Row)
-		*nrow = *row
-		nrow.Sheet = f.Sheets[toS]
-		nrow.Cells = make([]*xlsx.Cell, len(row.Cells))
-
-		for c := range nrow.Cells {
-			nrow.Cells[c] = new(xlsx.Cell)
-			*nrow.Cells[c] = *row.Cells[c]
-			nrow.Cells[c].Row = nrow
-		}
-
-		nrows = append(nrows, *nrow)
-		// (*f).Sheets[toS].Rows = append(f.Sheets[toS].Rows[0:startR], append([]*xlsx.Row{nrow}, (*f).Sheets[toS].Rows[startR:]...)...)
-	}*/
-
-	rows := f.Sheets[toS].Rows[0:startR]
-	for i := range nrows {
-		rows = append(rows, &nrows[i])
-	}
-
-	rows = append(rows, f.Sheets[toS].Rows[startR:]...)
-
-	(*f).Sheets[toS].Rows = rows
-
-	buf := bytes.NewBuffer(nil)
-	if err := f.Write(buf); err != nil {
-		return err
-	}
-
-	f1, err := xlsx.OpenBinary(buf.Bytes())
-	if err != nil {
-		return err
-	}
-
-	*f = *f1
-
-	return nil
-}
-
-/*func CloneSheet(f *xlsx.File, idx int) error {
-
-	if idx >= len(f.Sheets) {
-		return errors.New("CopySheet(): Invalid sheet index!")
-	}
-
-	// получаем в отдельный объект содержимое листа
-	s, err := f.AddSheet("0")
-	if err != nil {
-		return err
-	}
-
-	*s = *(f.Sheets[idx])
-	s.Cols = nil
-	s.Rows = nil
-
-	s.SheetViews = make([]xlsx.SheetView, len(f.Sheets[idx].SheetViews))
-	for i := range s.SheetViews {
-		s.SheetViews[i] = f.Sheets[idx].SheetViews[i]
-	}
-
-	// пока s.Rows, s.Cols это указатели на строки исходного листа
-	// надо их пересоздать
-
-	if err = CloneRows(f.Sheets[idx], s, 0, len(f.Sheets[idx].Rows)); err != nil {
-		return err
-	}
-
-	return nil
-}
-*/
-
-func CloneRows(from, to *xlsx.Sheet, start, end int) error {
-
-	for i := range from.Rows[start:end] {
-		row := new(xlsx.Row)
-		*row = *from.Rows[i]
-		row.Sheet = to
-		row.Cells = nil
-
-		for c := range from.Rows[i].Cells {
-			println("row", i, "cell", c, "Cell.style.NamedStyleIndex", from.Rows[i].Cells[c].GetStyle().NamedStyleIndex)
-			cell := row.AddCell()
-			//style := new(xlsx.Style)
-			*cell = *from.Rows[i].Cells[c]
-			//*style = *from.Rows[i].Cells[c].GetStyle()
-			//cell.Row = row
-			//cell.SetStyle(style)
-			//row.Cells = append(row.Cells, cell)
-
-		}
-
-		to.Rows = append(to.Rows, row)
-	}
-
-	for i := range from.Cols {
-		col := new(xlsx.Col)
-		*col = *from.Cols[i]
-		//style := new(xlsx.Style)
-		//*style = *from.Cols[i].GetStyle()
-		//col.SetStyle(style)
-		to.Cols = append(to.Cols, col)
-	}
-
-	return nil
-}
-
-// CloneSheet копирует лист as/is, присваивая новому листу имя name и производя
-// замену наименований переменных-плейсхолдеров с {{.D.Dyn.Name}} на {{.D.Dyn0.Name}}
-func CloneSheet(t *xlsx.File, idx int, name string, varFrom, varTo string) error {
-
-	if idx > len(t.Sheets) {
-		return errors.New("Недопустимый номер листа!")
-	}
-
-	_, err := t.AppendSheet(*t.Sheets[idx], name)
-	if err != nil {
-		return err
-	}
-
-	buf := bytes.NewBuffer(nil)
-	if err = t.Write(buf); err != nil {
-		return err
-	}
-
-	t1, err := xlsx.OpenBinary(buf.Bytes())
-	if err != nil {
-		return err
-	}
-
-	ReplaceVariableName(t1.Sheets[len(t1.Sheets)-1], varFrom, varTo)
-
-	*t = *t1
-	return nil
-}
-
-func ReplaceVariableName(s *xlsx.Sheet, from, to string) {
-
-	from = "." + from
-	to = "." + to
-	for r := range s.Rows {
-		for c := range s.Rows[r].Cells {
-			val := s.Rows[r].Cells[c].Value
-			if val == "" {
-				continue
-			}
-			if !(strings.Contains(val, "{{") && strings.Contains(val, "}}")) {
-				continue
-			}
-
-			if strings.Contains(val, from) {
-				s.Rows[r].Cells[c].SetString(strings.Replace(val, from, to, -1))
-				k := s.Rows[r].Cells[c].String()
-				println("rename", val, strings.Replace(val, from, to, -1), "result", k)
-			}
-		}
-	}
-}
-
-func insertRows(f *xlsx.File, s *xlsx.Sheet, startR, cnt int, row *xlsx.Row) error {
-
-	println("sheets", len(f.Sheets), "start", startR, "cnt", cnt)
-
-	// делаем глубокое копирование строк. То есть создаем несколько глубоких копий
-	// row в количестве cnt.
-	nrows := make([]*xlsx.Row, 0)
-	for i := 0; i < cnt; i++ {
-
-		nrow := new(xlsx.Row)
-		*nrow = *row
-		nrow.Sheet = s
-		nrow.Cells = nil
-
-		for c := range row.Cells {
-			println("row", i, "cell", c, "Cell.style.NamedStyleIndex", row.Cells[c].GetStyle().NamedStyleIndex)
-			cell := nrow.AddCell()
-			//style := new(xlsx.Style)
-			*cell = *row.Cells[c]
-			//*style = *from.Rows[i].Cells[c].GetStyle()
-			(*cell).Row = nrow
-			//cell.SetStyle(style)
-		}
-
-		(*s).Rows = append(s.Rows[0:startR], append([]*xlsx.Row{nrow}, (*s).Rows[startR:]...)...)
-
-	}
-
-	println("len(nrows)", len(nrows))
-
-	buf := bytes.NewBuffer(nil)
-	if err := f.Write(buf); err != nil {
-		return err
-	}
-
-	f1, err := xlsx.OpenBinary(buf.Bytes())
-	if err != nil {
-		return err
-	}
-
-	*f = *f1
-
-	return nil
-}
+package rbuilder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"text/template"
+
+	"github.com/tealeg/xlsx"
+)
+
+// Template is the workbook what has placeholders in cells. Placeholders
+// get {{.D}}, the data passed to Render, and {{.S}}, the static data of
+// NewTemplate. {{$.R}} is reserved for the render state, cells what refer
+// to it are rejected by Compile.
+type Template struct {
+	*xlsx.File
+	staticData interface{}
+	logger     Logger
+	locale     Locale
+	// round is the round mode of numeric functions
+	round RoundMode
+	// userFuncs are added by WithFuncs
+	userFuncs template.FuncMap
+	// autoFit is set by WithAutoFitRows
+	autoFit bool
+	// strictKeys is set by WithStrictKeys
+	strictKeys bool
+}
+
+func NewTemplate(tmpl *xlsx.File, staticData interface{}, opts ...Option) Template {
+	t := Template{File: tmpl, staticData: staticData, logger: nopLogger{}}
+	for _, opt := range opts {
+		opt(&t)
+	}
+	return t
+}
+
+// AwayFromZero rounds v to decimals digits, half is rounded away from zero.
+func AwayFromZero(v float64, decimals int) float64 {
+	return Round(v, decimals, RoundHalfUp)
+}
+
+var funcMap = template.FuncMap{
+
+	"fdate": func(s string, t time.Time) string { return t.Format(s) },
+	"nfmt": func(val int, base int) float64 {
+		return float64(val) / float64(base)
+	},
+	"symbol":    symbolFunc,
+	"inWords":   inWordsFunc,
+	"add":       addFunc,
+	"sub":       subFunc,
+	"mul":       mulFunc,
+	"div":       divFunc,
+	"sum":       sumFunc,
+	"count":     countFunc,
+	"avg":       avgFunc,
+	"min":       minFunc,
+	"max":       maxFunc,
+	"groupBy":   groupByFunc,
+	"merge":     mergeFunc,
+	"mergeSame": mergeSameFunc,
+	"formula":   formulaFunc,
+	"total":     totalFunc,
+	"color":     colorFunc,
+	"fill":      fillFunc,
+	"bold":      boldFunc,
+	"border":    borderFunc,
+}
+
+// numberFuncs returns functions what round numbers by the mode.
+func numberFuncs(mode RoundMode) template.FuncMap {
+	return template.FuncMap{
+		"toMeters":   scaledFunc(1000, 2, mode),
+		"toTonnes":   scaledFunc(1000, 3, mode),
+		"toKMeters":  scaledFunc(1000000, 3, mode),
+		"toRubles":   scaledFunc(100, 2, mode),
+		"conv":       convFunc(mode),
+		"round":      roundFunc(mode),
+		"sumInWords": sumInWordsFunc(mode),
+	}
+}
+
+// Prepared is compiled template what is ready for rendering. Prepared does
+// not change after compilation, so it is safe to Render it concurrently from
+// many goroutines.
+type Prepared struct {
+	// tmpl is the copy of the template workbook, it is never modified
+	tmpl       *xlsx.File
+	model      *compiled
+	staticData interface{}
+	logger     Logger
+	locale     Locale
+	autoFit    bool
+	// refs is set if the template has formulas, defined names, auto
+	// filters or vertical merges what should be moved together with rows
+	refs bool
+}
+
+// Compile parses placeholders and range blocks of the template once. Returned
+// Prepared does not depend on the template, later changes of the template
+// do not affect it.
+func (t *Template) Compile() (*Prepared, error) {
+
+	if t.File == nil {
+		return nil, errors.New("template file is not set")
+	}
+
+	// create template copy
+	f := cloneFile(t.File)
+
+	funcs := t.funcs()
+	if err := checkFuncs(funcs); err != nil {
+		return nil, err
+	}
+
+	logger := t.logger
+	if logger == nil {
+		logger = nopLogger{}
+	}
+
+	model, err := compile(f, parser{funcs: funcs, strict: t.strictKeys})
+	if err != nil {
+		logger.Error("compile failed", "error", err)
+		return nil, err
+	}
+
+	return &Prepared{tmpl: f, model: model, staticData: t.staticData, logger: logger, locale: t.locale, autoFit: t.autoFit, refs: hasRefs(f)}, nil
+}
+
+// funcs returns functions of placeholders of the template.
+func (t *Template) funcs() template.FuncMap {
+	res := make(template.FuncMap, len(funcMap))
+	for name, fn := range funcMap {
+		res[name] = fn
+	}
+	for name, fn := range numberFuncs(t.round) {
+		res[name] = fn
+	}
+	for name, fn := range t.locale.funcs(t.round) {
+		res[name] = fn
+	}
+	for name, fn := range t.userFuncs {
+		res[name] = fn
+	}
+	return res
+}
+
+// checkFuncs returns error if some of functions can not be called by
+// placeholders, text/template panics on such functions.
+func checkFuncs(funcs template.FuncMap) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid template function: %v", r)
+		}
+	}()
+	template.New("funcs").Funcs(funcs)
+	return nil
+}
+
+// Render generates report based on template. Returns new object xlsx what
+// inherits template with values instead of text/template placeholders.
+// Template is compiled on every call, use Compile to render the same
+// template many times.
+func (t *Template) Render(data interface{}) (*xlsx.File, error) {
+
+	p, err := t.Compile()
+	if err != nil {
+		return nil, err
+	}
+
+	return p.Render(data)
+}
+
+// Render generates report based on compiled template. Returns new object
+// xlsx what inherits template with values instead of text/template
+// placeholders.
+func (p *Prepared) Render(data interface{}) (res *xlsx.File, err error) {
+
+	defer func() { logResult(p.logger, "render", err) }()
+	defer recoverError(&err)
+
+	result := cloneFile(p.tmpl)
+
+	rr := &renderer{
+		report:  result,
+		data:    renderData{D: data, S: p.staticData, R: &renderState{}},
+		cols:    make(map[*xlsx.Cell][]colValue),
+		log:     p.logger,
+		locale:  p.locale,
+		refs:    p.refs,
+		autoFit: p.autoFit,
+	}
+
+	if err := rr.render(p.model); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// renderData is the root of every placeholder: {{.D}} is data passed to
+// Render and {{.S}} is static data of the template.
+type renderData struct {
+	D interface{}
+	S interface{}
+	// R is reserved for the code generated for range blocks and for
+	// directives, parser rejects cells what refer to it.
+	R *renderState
+}
+
+// renderState holds elements of ranges what are rendered at the moment.
+type renderState struct {
+	frames []interface{}
+	value  interface{}
+	// directives holds directives of the cell what is rendered now
+	directives []directive
+}
+
+// directive stores the directive of the cell what is rendered now.
+func (st *renderState) directive(name string, args ...string) {
+	st.directives = append(st.directives, directive{name: name, args: args})
+}
+
+// takeDirectives returns directives of the rendered cell and forgets them.
+func (st *renderState) takeDirectives() []directive {
+	dirs := st.directives
+	st.directives = nil
+	return dirs
+}
+
+// Capture stores value of range expression. It is used by the code
+// generated for range blocks.
+func (st *renderState) Capture(v interface{}) string {
+	st.value = v
+	return ""
+}
+
+// When stores the single element dot if cond is true and no elements
+// otherwise. It is used by the code generated for {{if}} blocks of rows.
+func (st *renderState) When(cond, dot interface{}) string {
+	st.value = nil
+	if ok, _ := template.IsTrue(cond); ok {
+		st.value = []interface{}{dot}
+	}
+	return ""
+}
+
+// Frame returns the current element of k-th nested range. It is used by
+// the code generated for range blocks.
+func (st *renderState) Frame(k int) (interface{}, error) {
+	if k < 0 || k >= len(st.frames) {
+		return nil, fmt.Errorf("range element %d is not rendered", k)
+	}
+	return st.frames[k], nil
+}
+
+// logResult logs the end of rendering, failed rendering is logged as error.
+func logResult(l Logger, msg string, err error) {
+	if err != nil {
+		l.Error(msg+" failed", "error", err)
+		return
+	}
+	l.Info(msg + " done")
+}
+
+// recoverError turns panic of rendering into error, so bad template cell
+// or unexpected data can not crash the calling program.
+func recoverError(err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("render failed: %v", r)
+	}
+}
+
+// renderer renders compiled template into the copy of the template workbook.
+type renderer struct {
+	report *xlsx.File
+	data   renderData
+	// cols holds rendered elements of {{range}}{{endcol.}} cells
+	cols map[*xlsx.Cell][]colValue
+	// same holds cells with {{mergeSame}}
+	same map[*xlsx.Cell]bool
+	// stream is set by RenderStream, top level blocks what iterate over
+	// channel or Iterator are not rendered but collected in streams
+	stream  bool
+	streams []*streamBlock
+	// ctx stops receiving elements of streamed blocks
+	ctx context.Context
+	// origin maps rows of streamed element to rows of the template band,
+	// copies of rows inherit origin of the source row
+	origin map[*xlsx.Row]*xlsx.Row
+	log    Logger
+	// locale recognises numbers in rendered text
+	locale Locale
+	// refs is set if references to rows should be moved
+	refs bool
+	// tc is the template cell what is rendered now and delta is the
+	// distance from its template row, {{formula}} moves references by delta
+	tc    *tmplCell
+	delta int
+	// totals holds cells with {{total}}
+	totals map[*xlsx.Cell]bool
+	// styles holds styles made by style directives
+	styles map[styleKey]*xlsx.Style
+	// autoFit is set by WithAutoFitRows, fit holds rows of rendered
+	// elements what get height of their text
+	autoFit bool
+	fit     map[*xlsx.Row]bool
+	// formulas maps formula cells of rows of sheets to the index of the
+	// sheet, their references are moved when blocks change rows
+	formulas map[*xlsx.Cell]int
+}
+
+func (rr *renderer) render(model *compiled) error {
+
+	// render static template values {{.Attr}}, what does not
+	// change amount of lines in result file
+	for s, ts := range model.sheets {
+		for _, tc := range ts.cells {
+			if err := rr.renderCell(s, rr.report.Sheets[s].Rows[tc.row], tc.row, tc); err != nil {
+				return err
+			}
+		}
+	}
+
+	rr.indexFormulas()
+
+	// render {{range}}{{end.}} what changes amount of lines.
+	// Блоки обрабатываются снизу вверх, тогда добавление или удаление строк
+	// не сдвигает еще не обработанные блоки.
+	for s, ts := range model.sheets {
+		for i := len(ts.blocks) - 1; i >= 0; i-- {
+			if err := rr.renderBlock(s, ts.blocks[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	// render {{range}}{{endcol.}} what changes amount of columns.
+	if err := rr.renderColumns(); err != nil {
+		return err
+	}
+
+	rr.mergeSame()
+
+	for _, sheet := range rr.report.Sheets {
+		rr.fixTotals(sheet.Rows)
+	}
+
+	rr.fitRows()
+
+	return nil
+}
+
+func (rr *renderer) exec(t *template.Template) (string, error) {
+	rr.data.R.directives = nil
+	buf := bytes.NewBuffer(nil)
+	if err := t.Execute(buf, rr.data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// value evaluates range expression and returns its value.
+func (rr *renderer) value(pipe *template.Template) (interface{}, error) {
+	rr.data.R.value = nil
+	if _, err := rr.exec(pipe); err != nil {
+		return nil, err
+	}
+	return rr.data.R.value, nil
+}
+
+// elements evaluates range expression and returns frames of its elements.
+func (rr *renderer) elements(pipe *template.Template) ([]interface{}, error) {
+	v, err := rr.value(pipe)
+	if err != nil {
+		return nil, err
+	}
+	return rangeFrames(v)
+}
+
+// renderCell renders template cell tc into the row what is r-th row of the
+// sheet s, the row may be not added to the sheet yet.
+func (rr *renderer) renderCell(s int, row *xlsx.Row, r int, tc *tmplCell) error {
+
+	if tc.pipe == nil {
+		rr.tc, rr.delta = tc, r-tc.loc.row
+		defer func() { rr.tc, rr.delta = nil, 0 }()
+
+		var err error
+		if tc.value != nil {
+			// значение ячейки записывается с сохранением типа
+			var v interface{}
+			if v, err = rr.value(tc.value); err == nil {
+				err = rr.setTyped(row, tc.col, v, rr.data.R.takeDirectives())
+			}
+		} else {
+			var str string
+			if str, err = rr.exec(tc.tmpl); err == nil {
+				err = rr.setValue(row, tc.col, str, rr.data.R.takeDirectives())
+			}
+		}
+		if err != nil {
+			return tc.loc.error(ExecError, err)
+		}
+		return nil
+	}
+
+	frames, err := rr.elements(tc.pipe)
+	if err != nil {
+		return tc.loc.error(ExecError, err)
+	}
+
+	st := rr.data.R
+	vals := make([]colValue, 0, len(frames))
+	for _, frame := range frames {
+		st.frames = append(st.frames, frame)
+		str, err := rr.exec(tc.tmpl)
+		if err != nil {
+			return tc.loc.error(ExecError, err)
+		}
+		st.frames = st.frames[:len(st.frames)-1]
+		vals = append(vals, colValue{text: str, dirs: st.takeDirectives()})
+	}
+
+	// значения будут записаны после того как станет известно
+	// количество колонок
+	cell := cellAt(row, tc.col)
+	cell.SetString("")
+	rr.cols[cell] = vals
+
+	return nil
+}
+
+// colValue is rendered element of {{range}}{{endcol.}} cell, directives of
+// the element are applied when the column of the element is known.
+type colValue struct {
+	text string
+	dirs []directive
+}
+
+// renderBlock replaces rows of top level block b of the sheet s by rows of
+// rendered elements. Rows of the sheet are replaced at once after all
+// elements are rendered.
+func (rr *renderer) renderBlock(s int, b *tmplBlock) error {
+
+	sheet := rr.report.Sheets[s]
+
+	// блоки ниже уже развернуты, поэтому блок на своем месте в шаблоне
+	at := b.top
+
+	v, err := rr.value(b.pipe)
+	if err != nil {
+		return b.loc.error(ExecError, err)
+	}
+
+	if rr.stream && isStream(v) {
+		// строки блока будут записаны при выводе листа
+		return rr.deferBlock(s, b, at, v)
+	}
+
+	frames, err := rangeFrames(v)
+	if err != nil {
+		return b.loc.error(ExecError, err)
+	}
+
+	band := sheet.Rows[at : at+b.height]
+	rows, moves, err := rr.expandBlock(s, b, band, at, frames)
+	if err != nil {
+		return err
+	}
+
+	if rr.refs {
+		rr.moveRefs(s, band, moves, at, len(rows))
+		moveMerges(sheet.Rows[:at], 0, moves, at)
+		if len(rows) == 0 && at+b.height < len(sheet.Rows) {
+			carryMerges(band, sheet.Rows[at+b.height])
+		}
+	}
+
+	res := make([]*xlsx.Row, 0, len(sheet.Rows)+len(rows)-b.height)
+	res = append(res, sheet.Rows[:at]...)
+	res = append(res, rows...)
+	sheet.Rows = append(res, sheet.Rows[at+b.height:]...)
+	sheet.MaxRow = len(sheet.Rows)
+
+	if rr.refs {
+		rr.indexRows(s, rows)
+	}
+
+	return nil
+}
+
+// expandBlock renders elements of block b into copies of band rows. Band
+// is placed at the row at of the sheet s, it is not changed. Returns rows
+// of all elements and changes of rows made by the expansion in the order
+// they are made, references outside of the block are moved by them.
+func (rr *renderer) expandBlock(s int, b *tmplBlock, band []*xlsx.Row, at int, frames []interface{}) ([]*xlsx.Row, []rowMapper, error) {
+
+	sheet := rr.report.Sheets[s]
+	h := b.height
+
+	if len(frames) == 0 {
+		// если генерация {{range}}{{end}} дала ноль записей,
+		// тогда из формируемого excel файла удаляются строчки
+		// содержащие тэги {{range}}{{end}}
+		rr.log.Debug("delete rows of empty range", "sheet", sheet.Name, "from", at, "to", at+h-1)
+		return nil, []rowMapper{rowShift{at: at, cnt: -h}}, nil
+	}
+
+	rr.log.Debug("expand range", "sheet", sheet.Name, "row", at, "elements", len(frames), "height", h)
+
+	// ссылки вне блока сдвигаются так, будто копии строк блока добавлены
+	// после него, затем изменениями строк каждого элемента
+	moves := []rowMapper{bandShift{at: at, height: h, ins: (len(frames) - 1) * h}}
+
+	// starts holds the first row of every element
+	starts := make([]int, 0, len(frames))
+	rows := make([]*xlsx.Row, 0, len(frames)*h)
+
+	st := rr.data.R
+	for _, frame := range frames {
+		st.frames = append(st.frames, frame)
+		elem, elemMoves, err := rr.renderElem(s, b, band, at)
+		st.frames = st.frames[:len(st.frames)-1]
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// элемент построен так, будто он на месте блока
+		for _, m := range elemMoves {
+			moves = append(moves, moveMapper(m, len(rows)))
+		}
+
+		starts = append(starts, len(rows))
+		rows = append(rows, elem...)
+	}
+
+	// относительные ссылки элемента на строки блока указывают на строки
+	// элемента, итоги под блоком охватывают все элементы
+	if rr.refs {
+		for k, start := range starts {
+			end := len(rows)
+			if k+1 < len(starts) {
+				end = starts[k+1]
+			}
+			sh := bandShift{at: at, height: end - start, ins: len(rows) - end + start, inside: true, delta: start}
+			for j, row := range rows[start:end] {
+				shiftCells(row, sheet.Name, true, sh)
+				if k+1 < len(starts) {
+					clipMerges(row, j, end-start)
+				}
+			}
+		}
+	}
+
+	return rows, moves, nil
+}
+
+// renderElem renders the current element of block b into copies of band
+// rows, the element is placed at the row at. Returns rows of the element
+// after nested blocks are expanded and changes of rows made by nested
+// blocks.
+func (rr *renderer) renderElem(s int, b *tmplBlock, band []*xlsx.Row, at int) ([]*xlsx.Row, []rowMapper, error) {
+
+	sheet := rr.report.Sheets[s]
+
+	elem := make([]*xlsx.Row, len(band))
+	for i, row := range band {
+		elem[i] = rr.copyRow(row, sheet)
+	}
+
+	for _, tc := range b.cells {
+		if err := rr.renderCell(s, elem[tc.row], at+tc.row, tc); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// вложенные блоки разворачиваются снизу вверх, тогда строки блоков
+	// выше остаются на своих местах
+	var moves []rowMapper
+	for k := len(b.blocks) - 1; k >= 0; k-- {
+		nb := b.blocks[k]
+		o := nb.top - b.top
+
+		frames, err := rr.elements(nb.pipe)
+		if err != nil {
+			return nil, nil, nb.loc.error(ExecError, err)
+		}
+
+		nband := elem[o : o+nb.height]
+		rows, nmoves, err := rr.expandBlock(s, nb, nband, at+o, frames)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if rr.refs {
+			// остальные строки элемента
+			for _, part := range [][]*xlsx.Row{elem[:o], elem[o+nb.height:]} {
+				for _, row := range part {
+					for _, cell := range row.Cells {
+						moveCell(cell, sheet.Name, true, nmoves, at+o, nb.height, len(rows))
+					}
+				}
+			}
+			moveMerges(elem[:o], at, nmoves, at+o)
+			if len(rows) == 0 && o+nb.height < len(elem) {
+				carryMerges(nband, elem[o+nb.height])
+			}
+		}
+
+		res := make([]*xlsx.Row, 0, len(elem)+len(rows)-nb.height)
+		res = append(res, elem[:o]...)
+		res = append(res, rows...)
+		elem = append(res, elem[o+nb.height:]...)
+
+		moves = append(moves, nmoves...)
+	}
+
+	rr.markFit(elem)
+
+	return elem, moves, nil
+}
+
+// copyRow returns copy of the row what belongs to the sheet. Cells of the
+// copy inherit values of {{range}}{{endcol.}} cells and other marks of the
+// renderer, the copy inherits origin of the row.
+func (rr *renderer) copyRow(row *xlsx.Row, sheet *xlsx.Sheet) *xlsx.Row {
+
+	res := cloneRow(row, sheet)
+
+	for c, cell := range row.Cells {
+		if vals, ok := rr.cols[cell]; ok {
+			rr.cols[res.Cells[c]] = vals
+		}
+		if rr.same[cell] {
+			rr.same[res.Cells[c]] = true
+		}
+		if rr.totals[cell] {
+			rr.totals[res.Cells[c]] = true
+		}
+	}
+
+	if o, ok := rr.origin[row]; ok {
+		rr.origin[res] = o
+	}
+
+	return res
+}
+
+// rangeFrames returns frame for every element of the value what is iterated
+// by {{range}}. Frame is a map with the single entry: index or key of the
+// element and the element itself.
+func rangeFrames(v interface{}) ([]interface{}, error) {
+
+	frames := make([]interface{}, 0)
+	err := eachFrame(context.Background(), v, func(frame interface{}) error {
+		frames = append(frames, frame)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return frames, nil
+}
+
+// eachFrame calls fn for frame of every element of v. Elements of channel
+// and Iterator are received one by one, they are not collected. Receiving
+// stops with ctx.Err() when ctx is done.
+func eachFrame(ctx context.Context, v interface{}, fn func(frame interface{}) error) error {
+
+	if it, ok := v.(Iterator); ok {
+		for i := 0; ; i++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			e, err := it.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := fn(map[int]interface{}{i: e}); err != nil {
+				return err
+			}
+		}
+	}
+
+	val := reflect.ValueOf(v)
+	for val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface {
+		if val.IsNil() {
+			return nil
+		}
+		val = val.Elem()
+	}
+
+	frame := func(k, e reflect.Value) interface{} {
+		m := reflect.MakeMap(reflect.MapOf(k.Type(), e.Type()))
+		m.SetMapIndex(k, e)
+		return m.Interface()
+	}
+
+	switch val.Kind() {
+	case reflect.Invalid:
+	case reflect.Array, reflect.Slice:
+		for i := 0; i < val.Len(); i++ {
+			if err := fn(frame(reflect.ValueOf(i), val.Index(i))); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		keys := val.MapKeys()
+		sortKeys(keys)
+		for _, k := range keys {
+			if err := fn(frame(k, val.MapIndex(k))); err != nil {
+				return err
+			}
+		}
+	case reflect.Chan:
+		if val.IsNil() {
+			break
+		}
+		cases := []reflect.SelectCase{
+			{Dir: reflect.SelectRecv, Chan: val},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+		}
+		for i := 0; ; i++ {
+			chosen, e, ok := reflect.Select(cases)
+			if chosen == 1 {
+				return ctx.Err()
+			}
+			if !ok {
+				break
+			}
+			if err := fn(frame(reflect.ValueOf(i), e)); err != nil {
+				return err
+			}
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		for i := int64(0); i < val.Int(); i++ {
+			if err := fn(frame(reflect.ValueOf(int(i)), reflect.ValueOf(int(i)))); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("range can't iterate over %v", v)
+	}
+
+	return nil
+}
+
+// sortKeys sorts keys of the map the same way as text/template does.
+func sortKeys(keys []reflect.Value) {
+	if len(keys) == 0 {
+		return
+	}
+
+	var less func(i, j int) bool
+	switch keys[0].Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		less = func(i, j int) bool { return keys[i].Int() < keys[j].Int() }
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		less = func(i, j int) bool { return keys[i].Uint() < keys[j].Uint() }
+	case reflect.Float32, reflect.Float64:
+		less = func(i, j int) bool { return keys[i].Float() < keys[j].Float() }
+	case reflect.String:
+		less = func(i, j int) bool { return keys[i].String() < keys[j].String() }
+	default:
+		return
+	}
+
+	sort.Slice(keys, less)
+}
+
+// renderColumns writes elements of {{range}}{{endcol.}} cells. Template
+// column is repeated to the right as many times as the longest range in the
+// column has elements, or removed if all ranges in the column are empty.
+func (rr *renderer) renderColumns() error {
+
+	for s, sheet := range rr.report.Sheets {
+
+		// width holds amount of columns required by template column
+		width := make(map[int]int)
+		for _, row := range sheet.Rows {
+			for c, cell := range row.Cells {
+				vals, ok := rr.cols[cell]
+				if !ok {
+					continue
+				}
+				if n, ok := width[c]; !ok || len(vals) > n {
+					width[c] = len(vals)
+				}
+			}
+		}
+
+		cols := make([]int, 0, len(width))
+		for c := range width {
+			cols = append(cols, c)
+		}
+
+		// columns are processed from right to left, so inserted columns
+		// do not shift columns what are not processed yet
+		sort.Sort(sort.Reverse(sort.IntSlice(cols)))
+
+		for _, c := range cols {
+			rr.log.Debug("expand column range", "sheet", sheet.Name, "column", c, "width", width[c])
+
+			if width[c] == 0 {
+				delCol(sheet, c)
+				if rr.refs {
+					rr.moveColRefs(s, c, -1)
+				}
+				continue
+			}
+
+			insertCols(sheet, c, width[c]-1)
+
+			for _, row := range sheet.Rows {
+				if c >= len(row.Cells) {
+					continue
+				}
+
+				vals, ok := rr.cols[row.Cells[c]]
+				if !ok {
+					continue
+				}
+
+				for k := 0; k < width[c]; k++ {
+					if k >= len(vals) {
+						row.Cells[c+k].SetString("")
+						continue
+					}
+					if err := rr.setValue(row, c+k, vals[k].text, vals[k].dirs); err != nil {
+						return err
+					}
+				}
+			}
+
+			if rr.refs {
+				rr.moveColRefs(s, c, width[c]-1)
+			}
+		}
+	}
+
+	return nil
+}
+
+// cellAt returns the cell c of the row, missing cells are added.
+func cellAt(row *xlsx.Row, c int) *xlsx.Cell {
+	for len(row.Cells) <= c {
+		row.AddCell()
+	}
+	return row.Cells[c]
+}
+
+// setValue applies directives of the cell c of the row and writes rendered
+// text into the cell. Text what is a number is written as a number.
+func (rr *renderer) setValue(row *xlsx.Row, c int, str string, dirs []directive) error {
+
+	cell := cellAt(row, c)
+
+	written, err := rr.applyDirectives(cell, dirs)
+	if err != nil || written {
+		return err
+	}
+
+	numberFormat := cell.GetNumberFormat()
+
+	if numberFormat == "@" {
+		cell.SetString(str)
+		return nil
+	}
+
+	// число в локали разбирается первым, иначе "1.234" при разделителе
+	// групп "." стало бы 1.234
+	if val, ok := rr.locale.ParseNumber(str); ok {
+		cell.SetFloat(val)
+		cell.NumFmt = numberFormat
+		return nil
+	}
+
+	if val, err := strconv.ParseFloat(str, 10); err == nil {
+		cell.SetFloat(val)
+		cell.NumFmt = numberFormat
+		return nil
+	}
+
+	if val, err := strconv.ParseInt(str, 10, 64); err == nil {
+		cell.SetInt64(val)
+		cell.NumFmt = numberFormat
+		return nil
+	}
+
+	cell.SetString(str)
+
+	return nil
+}
+
+func appendRows(from, to *xlsx.File, fromS, fromR, toR, toS int) error {
+
+	if from == nil {
+		return errors.New("invalid source file")
+	}
+
+	if to == nil {
+		return errors.New("invalid target file")
+	}
+
+	if fromS >= len(from.Sheets) {
+		return errors.New("invalid scheet number from")
+	}
+
+	if toS >= len(to.Sheets) {
+		return errors.New("invalid scheet number to")
+	}
+
+	if fromR >= len(from.Sheets[fromS].Rows) {
+		return errors.New("invalid starting row in source scheet")
+	}
+
+	if toR >= len(from.Sheets[fromS].Rows) {
+		return errors.New("invalid ending row in source scheet")
+	}
+	/*
+		for i := fromR; i <= toR; i++ {
+			row := to.Sheets[toS].AddRow()
+			for _, c := range from.Sheets[fromS].Rows[i].Cells {
+				cell := row.AddCell()
+				cell.SetStyle(c.GetStyle())
+				cell.SetValue(c.Value)
+			}
+		}
+	*/
+
+	sheet := to.Sheets[toS]
+	for i := fromR; i <= toR; i++ {
+		sheet.Rows = append(sheet.Rows, cloneRow(from.Sheets[fromS].Rows[i], sheet))
+	}
+	sheet.MaxRow = len(sheet.Rows)
+	fixCols(sheet)
+
+	return nil
+}
+
+/*func CloneSheet(f *xlsx.File, idx int) error {
+
+	if idx >= len(f.Sheets) {
+		return errors.New("CopySheet(): Invalid sheet index!")
+	}
+
+	// получаем в отдельный объект содержимое листа
+	s, err := f.AddSheet("0")
+	if err != nil {
+		return err
+	}
+
+	*s = *(f.Sheets[idx])
+	s.Cols = nil
+	s.Rows = nil
+
+	s.SheetViews = make([]xlsx.SheetView, len(f.Sheets[idx].SheetViews))
+	for i := range s.SheetViews {
+		s.SheetViews[i] = f.Sheets[idx].SheetViews[i]
+	}
+
+	// пока s.Rows, s.Cols это указатели на строки исходного листа
+	// надо их пересоздать
+
+	if err = CloneRows(f.Sheets[idx], s, 0, len(f.Sheets[idx].Rows)); err != nil {
+		return err
+	}
+
+	return nil
+}
+*/
+
+// CloneRows appends deep copies of rows [start, end) of the sheet from and
+// copies of its columns to the sheet to.
+func CloneRows(from, to *xlsx.Sheet, start, end int) error {
+
+	if start < 0 || end > len(from.Rows) || start > end {
+		return errors.New("CloneRows(): invalid rows range")
+	}
+
+	for _, row := range from.Rows[start:end] {
+		to.Rows = append(to.Rows, cloneRow(row, to))
+	}
+	to.MaxRow = len(to.Rows)
+
+	for i := range from.Cols {
+		to.Cols = append(to.Cols, cloneCol(from.Cols[i]))
+	}
+	fixCols(to)
+
+	return nil
+}
+
+// CloneSheet копирует лист as/is, присваивая новому листу имя name и производя
+// замену наименований переменных-плейсхолдеров с {{.D.Dyn.Name}} на {{.D.Dyn0.Name}}
+func CloneSheet(t *xlsx.File, idx int, name string, varFrom, varTo string) error {
+
+	if idx < 0 || idx >= len(t.Sheets) {
+		return errors.New("Недопустимый номер листа!")
+	}
+
+	sheet, err := cloneSheet(t, t.Sheets[idx], name)
+	if err != nil {
+		return err
+	}
+	sheet.Selected = false
+
+	ReplaceVariableName(sheet, varFrom, varTo)
+
+	return nil
+}
+
+// cloneFile returns deep copy of the workbook. Styles are shared by the
+// copy and the workbook, they are not changed by rendering.
+func cloneFile(f *xlsx.File) *xlsx.File {
+
+	res := xlsx.NewFile()
+	res.Date1904 = f.Date1904
+
+	for _, dn := range f.DefinedNames {
+		n := *dn
+		res.DefinedNames = append(res.DefinedNames, &n)
+	}
+
+	for _, sheet := range f.Sheets {
+		// имена листов исходной книги уже проверены
+		_, _ = cloneSheet(res, sheet, sheet.Name)
+	}
+
+	return res
+}
+
+// cloneSheet appends deep copy of the sheet to the workbook f.
+func cloneSheet(f *xlsx.File, sheet *xlsx.Sheet, name string) (*xlsx.Sheet, error) {
+
+	if _, ok := f.Sheet[name]; ok {
+		return nil, fmt.Errorf("duplicate sheet name '%s'", name)
+	}
+
+	res := new(xlsx.Sheet)
+	*res = *sheet
+	res.Name = name
+	res.File = f
+
+	res.Rows = make([]*xlsx.Row, len(sheet.Rows))
+	for i, row := range sheet.Rows {
+		res.Rows[i] = cloneRow(row, res)
+	}
+
+	res.Cols = make([]*xlsx.Col, len(sheet.Cols))
+	for i, col := range sheet.Cols {
+		res.Cols[i] = cloneCol(col)
+	}
+
+	res.SheetViews = make([]xlsx.SheetView, len(sheet.SheetViews))
+	for i, view := range sheet.SheetViews {
+		if view.Pane != nil {
+			pane := *view.Pane
+			view.Pane = &pane
+		}
+		res.SheetViews[i] = view
+	}
+
+	if sheet.AutoFilter != nil {
+		filter := *sheet.AutoFilter
+		res.AutoFilter = &filter
+	}
+
+	f.Sheet[name] = res
+	f.Sheets = append(f.Sheets, res)
+
+	return res, nil
+}
+
+// cloneRow returns deep copy of the row what belongs to the sheet.
+func cloneRow(row *xlsx.Row, sheet *xlsx.Sheet) *xlsx.Row {
+
+	res := new(xlsx.Row)
+	*res = *row
+	res.Sheet = sheet
+	res.Cells = make([]*xlsx.Cell, len(row.Cells))
+
+	for c, cell := range row.Cells {
+		ncell := new(xlsx.Cell)
+		*ncell = *cell
+		ncell.Row = res
+		if cell.DataValidation != nil {
+			dv := *cell.DataValidation
+			ncell.DataValidation = &dv
+		}
+		res.Cells[c] = ncell
+	}
+
+	return res
+}
+
+func cloneCol(col *xlsx.Col) *xlsx.Col {
+
+	res := new(xlsx.Col)
+	*res = *col
+
+	if col.DataValidation != nil {
+		res.DataValidation = append(col.DataValidation[:0:0], col.DataValidation...)
+		for i, dv := range col.DataValidation {
+			v := *dv
+			res.DataValidation[i] = &v
+		}
+	}
+
+	return res
+}
+
+func ReplaceVariableName(s *xlsx.Sheet, from, to string) {
+
+	from = "." + from
+	to = "." + to
+	for r := range s.Rows {
+		for c := range s.Rows[r].Cells {
+			val := s.Rows[r].Cells[c].Value
+			if val == "" {
+				continue
+			}
+			if !(strings.Contains(val, "{{") && strings.Contains(val, "}}")) {
+				continue
+			}
+
+			if strings.Contains(val, from) {
+				s.Rows[r].Cells[c].SetString(strings.Replace(val, from, to, -1))
+			}
+		}
+	}
+}
+
+// hasRefs reports whether the workbook has formulas, defined names, auto
+// filters or vertical merges what refer to rows.
+func hasRefs(f *xlsx.File) bool {
+
+	if len(f.DefinedNames) > 0 {
+		return true
+	}
+
+	for _, sheet := range f.Sheets {
+		if sheet.AutoFilter != nil {
+			return true
+		}
+		for _, row := range sheet.Rows {
+			for _, cell := range row.Cells {
+				if cell.Formula() != "" || cell.VMerge > 0 {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// insertCols inserts cnt copies of the column c right after it. Cells and
+// widths of columns to the right are shifted, merged regions what cover
+// the column are widened.
+func insertCols(s *xlsx.Sheet, c, cnt int) {
+
+	if cnt <= 0 {
+		return
+	}
+
+	for _, row := range s.Rows {
+		for i := 0; i < c && i < len(row.Cells); i++ {
+			if row.Cells[i].HMerge > 0 && i+row.Cells[i].HMerge >= c {
+				row.Cells[i].HMerge += cnt
+			}
+		}
+
+		if c >= len(row.Cells) {
+			continue
+		}
+
+		cells := make([]*xlsx.Cell, 0, len(row.Cells)+cnt)
+		cells = append(cells, row.Cells[:c+1]...)
+		for i := 0; i < cnt; i++ {
+			cell := new(xlsx.Cell)
+			*cell = *row.Cells[c]
+			cell.Row = row
+			cells = append(cells, cell)
+		}
+		row.Cells = append(cells, row.Cells[c+1:]...)
+	}
+
+	if c < len(s.Cols) {
+		cols := make([]*xlsx.Col, 0, len(s.Cols)+cnt)
+		cols = append(cols, s.Cols[:c+1]...)
+		for i := 0; i < cnt; i++ {
+			col := new(xlsx.Col)
+			*col = *s.Cols[c]
+			cols = append(cols, col)
+		}
+		s.Cols = append(cols, s.Cols[c+1:]...)
+	}
+
+	fixCols(s)
+}
+
+// delCol removes the column c. Cells and widths of columns to the right are
+// shifted, merged regions what cover the column are narrowed.
+func delCol(s *xlsx.Sheet, c int) {
+
+	for _, row := range s.Rows {
+		for i := 0; i < c && i < len(row.Cells); i++ {
+			if row.Cells[i].HMerge > 0 && i+row.Cells[i].HMerge >= c {
+				row.Cells[i].HMerge--
+			}
+		}
+
+		if c < len(row.Cells) {
+			row.Cells = append(row.Cells[:c], row.Cells[c+1:]...)
+		}
+	}
+
+	if c < len(s.Cols) {
+		s.Cols = append(s.Cols[:c], s.Cols[c+1:]...)
+	}
+
+	fixCols(s)
+}
+
+// fixCols makes every column description to cover exactly one column and
+// adds missing descriptions, so each cell of the sheet has its column.
+func fixCols(s *xlsx.Sheet) {
+
+	s.MaxCol = len(s.Cols)
+	for i := range s.Cols {
+		s.Cols[i].Min = i + 1
+		s.Cols[i].Max = i + 1
+	}
+
+	for _, row := range s.Rows {
+		if len(row.Cells) > 0 {
+			s.Col(len(row.Cells) - 1)
+		}
+	}
+}
@@ -0,0 +1,654 @@
+package rbuilder
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/tealeg/xlsx"
+)
+
+// rowMapper tells where rows referred by formulas are moved. abs is set for
+// absolute references like $5. Columns are moved by the same mappers, see
+// shiftColFormula.
+type rowMapper interface {
+	// row returns new index of the row r, ok is false if the row is deleted.
+	row(r int, abs bool) (int, bool)
+	// area returns new bounds of the rows area, ok is false if all rows of
+	// the area are deleted.
+	area(top, bottom int, absTop, absBottom bool) (int, int, bool)
+}
+
+// rowShift describes insertion (cnt > 0) or deletion (cnt < 0) of rows
+// what starts at the row at.
+type rowShift struct {
+	at  int
+	cnt int
+}
+
+func (sh rowShift) row(r int, abs bool) (int, bool) {
+	return sh.move(r)
+}
+
+func (sh rowShift) move(r int) (int, bool) {
+	if r < sh.at {
+		return r, true
+	}
+	if sh.cnt < 0 && r < sh.at-sh.cnt {
+		return 0, false
+	}
+	return r + sh.cnt, true
+}
+
+// area shrinks the area what is cut by deletion and grows the area what
+// covers inserted rows.
+func (sh rowShift) area(top, bottom int, absTop, absBottom bool) (int, int, bool) {
+
+	t, okT := sh.move(top)
+	b, okB := sh.move(bottom)
+	if okT && okB {
+		return t, b, true
+	}
+
+	if !okT && !okB {
+		return 0, 0, false
+	}
+
+	if !okT {
+		// удалены верхние строки области
+		t = sh.at
+	}
+	if !okB {
+		// удалены нижние строки области
+		b = sh.at - 1
+	}
+
+	return t, b, true
+}
+
+// bandShift describes repetition of the band of rows [at, at+height): ins
+// rows are added right after the band. Formulas outside of the band keep
+// references to the band, but areas what end at the last row of the band
+// grow over added rows, so totals cover every element. Formulas of the band
+// copy (inside is set) move relative references to the band by delta.
+type bandShift struct {
+	at     int
+	height int
+	ins    int
+	inside bool
+	delta  int
+}
+
+func (sh bandShift) inBand(r int) bool {
+	return r >= sh.at && r < sh.at+sh.height
+}
+
+func (sh bandShift) row(r int, abs bool) (int, bool) {
+	if sh.inside && !abs && sh.inBand(r) {
+		return r + sh.delta, true
+	}
+	if r >= sh.at+sh.height {
+		return r + sh.ins, true
+	}
+	return r, true
+}
+
+func (sh bandShift) area(top, bottom int, absTop, absBottom bool) (int, int, bool) {
+
+	t, _ := sh.row(top, absTop)
+
+	b := bottom
+	switch {
+	case sh.inside && !absBottom && sh.inBand(bottom):
+		b = bottom + sh.delta
+	case bottom >= sh.at+sh.height-1:
+		b = bottom + sh.ins
+	}
+
+	return t, b, true
+}
+
+// rowOffset moves relative references by the amount of rows, like Excel
+// does when the formula is copied to another row.
+type rowOffset int
+
+func (d rowOffset) row(r int, abs bool) (int, bool) {
+	if abs {
+		return r, true
+	}
+	r += int(d)
+	return r, r >= 0
+}
+
+func (d rowOffset) area(top, bottom int, absTop, absBottom bool) (int, int, bool) {
+	t, okT := d.row(top, absTop)
+	b, okB := d.row(bottom, absBottom)
+	return t, b, okT && okB
+}
+
+// moveMapper returns the same change of rows made d rows lower.
+func moveMapper(m rowMapper, d int) rowMapper {
+	switch m := m.(type) {
+	case rowShift:
+		m.at += d
+		return m
+	case bandShift:
+		m.at += d
+		return m
+	}
+	return m
+}
+
+// refBounds records the first and the last rows what references of the
+// formula point at, rows are not moved.
+type refBounds struct {
+	found    bool
+	min, max int
+}
+
+func (rb *refBounds) add(r int) {
+	if !rb.found || r < rb.min {
+		rb.min = r
+	}
+	if !rb.found || r > rb.max {
+		rb.max = r
+	}
+	rb.found = true
+}
+
+func (rb *refBounds) row(r int, abs bool) (int, bool) {
+	rb.add(r)
+	return r, true
+}
+
+func (rb *refBounds) area(top, bottom int, absTop, absBottom bool) (int, int, bool) {
+	rb.add(top)
+	rb.add(bottom)
+	return top, bottom, true
+}
+
+// moveFormula moves references of the formula what point at the sheet by
+// changes of rows what are made by expansion of the block [at, at+h) into
+// l rows. Changes are applied one by one only to references of the block,
+// references below of the block are moved at once.
+func moveFormula(formula, sheet string, local bool, moves []rowMapper, at, h, l int) string {
+
+	var rb refBounds
+	shiftFormula(formula, sheet, local, &rb)
+
+	switch {
+	case !rb.found || rb.max < at:
+		return formula
+	case rb.min >= at+h:
+		// строки под блоком сдвигаются на изменение высоты блока
+		if l < h {
+			return shiftFormula(formula, sheet, local, rowShift{at: at + l, cnt: l - h})
+		}
+		return shiftFormula(formula, sheet, local, rowShift{at: at + h, cnt: l - h})
+	}
+
+	for _, m := range moves {
+		formula = shiftFormula(formula, sheet, local, m)
+	}
+
+	return formula
+}
+
+// moveCell moves references of the formula of the cell, see moveFormula.
+func moveCell(cell *xlsx.Cell, sheet string, local bool, moves []rowMapper, at, h, l int) {
+
+	formula := cell.Formula()
+	if formula == "" {
+		return
+	}
+
+	setFormulaText(cell, moveFormula(formula, sheet, local, moves, at, h, l))
+}
+
+// setFormulaText replaces the formula of the cell keeping its type.
+func setFormulaText(cell *xlsx.Cell, formula string) {
+
+	if formula == cell.Formula() {
+		return
+	}
+
+	if cell.Type() == xlsx.CellTypeStringFormula {
+		cell.SetStringFormula(formula)
+	} else {
+		cell.SetFormula(formula)
+	}
+}
+
+// indexFormulas remembers formula cells of all sheets, references of them
+// are moved by blocks without walking all rows of the workbook.
+func (rr *renderer) indexFormulas() {
+
+	rr.formulas = make(map[*xlsx.Cell]int)
+
+	if !rr.refs {
+		return
+	}
+
+	for s, sheet := range rr.report.Sheets {
+		rr.indexRows(s, sheet.Rows)
+	}
+}
+
+// indexRows adds formula cells of rows of the sheet s to the index.
+func (rr *renderer) indexRows(s int, rows []*xlsx.Row) {
+	for _, row := range rows {
+		for _, cell := range row.Cells {
+			if cell.Formula() != "" {
+				rr.formulas[cell] = s
+			}
+		}
+	}
+}
+
+// moveRefs moves references to rows of the sheet s after the block band
+// at the row at is replaced by l rows: formulas of the index except of
+// cells of the band, defined names and auto filter of the sheet. Cells of
+// the band are removed from the index.
+func (rr *renderer) moveRefs(s int, band []*xlsx.Row, moves []rowMapper, at, l int) {
+
+	f := rr.report
+	name := f.Sheets[s].Name
+	h := len(band)
+
+	skip := make(map[*xlsx.Row]bool, h)
+	for _, row := range band {
+		skip[row] = true
+	}
+
+	for cell, i := range rr.formulas {
+		if i == s && skip[cell.Row] {
+			delete(rr.formulas, cell)
+			continue
+		}
+		moveCell(cell, name, i == s, moves, at, h, l)
+	}
+
+	rr.moveNames(s, func(formula string, local bool) string {
+		return moveFormula(formula, name, local, moves, at, h, l)
+	})
+}
+
+// moveColRefs moves references to columns of the sheet s after the column
+// c is repeated cnt times or is deleted if cnt is negative: formulas of all
+// sheets, defined names and auto filter of the sheet. Formulas of the
+// column and of its copies move relative references to the column like
+// copied formulas do.
+func (rr *renderer) moveColRefs(s, c, cnt int) {
+
+	f := rr.report
+	name := f.Sheets[s].Name
+
+	var out rowMapper = bandShift{at: c, height: 1, ins: cnt}
+	if cnt < 0 {
+		out = rowShift{at: c, cnt: -1}
+	}
+
+	for i, sheet := range f.Sheets {
+		for _, row := range sheet.Rows {
+			for k, cell := range row.Cells {
+				formula := cell.Formula()
+				if formula == "" {
+					continue
+				}
+				sh := out
+				if i == s && cnt >= 0 && k >= c && k <= c+cnt {
+					sh = bandShift{at: c, height: 1, ins: cnt, inside: true, delta: k - c}
+				}
+				setFormulaText(cell, shiftColFormula(formula, name, i == s, sh))
+			}
+		}
+	}
+
+	rr.moveNames(s, func(formula string, local bool) string {
+		return shiftColFormula(formula, name, local, out)
+	})
+}
+
+// moveNames moves references of defined names of the workbook and of auto
+// filter of the sheet s by move, local is set for references what belong
+// to the sheet. Auto filter what lost its area is removed.
+func (rr *renderer) moveNames(s int, move func(formula string, local bool) string) {
+
+	f := rr.report
+
+	// области печати и другие имена всегда ссылаются на лист по имени
+	for _, dn := range f.DefinedNames {
+		dn.Data = move(dn.Data, false)
+	}
+
+	sheet := f.Sheets[s]
+
+	if af := sheet.AutoFilter; af != nil {
+		ref := move(af.TopLeftCell+":"+af.BottomRightCell, true)
+		if parts := strings.Split(ref, ":"); len(parts) == 2 {
+			af.TopLeftCell, af.BottomRightCell = parts[0], parts[1]
+		} else {
+			rr.log.Warn("auto filter is removed, its cells are deleted", "sheet", sheet.Name, "ref", ref)
+			sheet.AutoFilter = nil
+		}
+	}
+}
+
+// shiftCells moves references of formulas of the row what point at the
+// sheet. Local row belongs to the sheet.
+func shiftCells(row *xlsx.Row, sheet string, local bool, m rowMapper) {
+
+	for _, cell := range row.Cells {
+		formula := cell.Formula()
+		if formula == "" {
+			continue
+		}
+		setFormulaText(cell, shiftFormula(formula, sheet, local, m))
+	}
+}
+
+// moveMerges moves bottoms of merged cells of rows above of the row at by
+// changes of rows, so merged cells what cover the block grow or shrink
+// with it. Rows start at the row first.
+func moveMerges(rows []*xlsx.Row, first int, moves []rowMapper, at int) {
+
+	for i, row := range rows {
+		r := first + i
+		if r >= at {
+			break
+		}
+		for _, cell := range row.Cells {
+			if cell.VMerge == 0 || r+cell.VMerge < at {
+				continue
+			}
+			bottom := r + cell.VMerge
+			for _, m := range moves {
+				_, bottom, _ = m.area(r, bottom, false, false)
+			}
+			cell.VMerge = bottom - r
+		}
+	}
+}
+
+// carryMerges passes merged cells what start in deleted band rows and go
+// below of the band to the row next after the band.
+func carryMerges(band []*xlsx.Row, next *xlsx.Row) {
+
+	for j, row := range band {
+		for c, cell := range row.Cells {
+			if cell.VMerge == 0 || j+cell.VMerge < len(band) || c >= len(next.Cells) {
+				continue
+			}
+			next.Cells[c].HMerge = cell.HMerge
+			next.Cells[c].VMerge = j + cell.VMerge - len(band)
+		}
+	}
+}
+
+// clipMerges cuts merged cells of the band copy row what go below of the
+// band, copies of the band must not overlap. j is the index of the row in
+// the band.
+func clipMerges(row *xlsx.Row, j, height int) {
+
+	for _, cell := range row.Cells {
+		if cell.VMerge > height-1-j {
+			cell.VMerge = height - 1 - j
+		}
+	}
+}
+
+var (
+	cellRef = regexp.MustCompile(`^(\$?[A-Za-z]{1,3})(\$?)([0-9]+)$`)
+	rowRef  = regexp.MustCompile(`^(\$?)([0-9]+)$`)
+	colRef  = regexp.MustCompile(`^(\$?)([A-Za-z]{1,3})$`)
+)
+
+// shiftFormula moves row references of the formula what point at the
+// sheet, empty sheet means references to any sheet. Local formula belongs
+// to the sheet, so its references without sheet name point at the sheet
+// too. References to deleted rows are replaced by #REF!.
+func shiftFormula(formula, sheet string, local bool, sh rowMapper) string {
+	return shiftRefs(formula, sheet, local, sh, false)
+}
+
+// shiftColFormula moves column references of the formula like shiftFormula
+// moves rows, sh maps indexes of columns.
+func shiftColFormula(formula, sheet string, local bool, sh rowMapper) string {
+	return shiftRefs(formula, sheet, local, sh, true)
+}
+
+// shiftRefs moves row references of the formula or column ones if cols is
+// set.
+func shiftRefs(formula, sheet string, local bool, sh rowMapper, cols bool) string {
+
+	var b strings.Builder
+
+	for i := 0; i < len(formula); {
+		ch := formula[i]
+
+		switch {
+		case ch == '"':
+			// строковая константа
+			j := skipQuoted(formula, i)
+			b.WriteString(formula[i:j])
+			i = j
+
+		case ch == '\'':
+			// имя листа в кавычках
+			j := skipQuoted(formula, i)
+			if j < len(formula) && formula[j] == '!' {
+				name := strings.Replace(formula[i+1:j-1], "''", "'", -1)
+				b.WriteString(formula[i : j+1])
+				i = shiftRef(&b, formula, j+1, isTarget(name, sheet), sh, cols)
+				continue
+			}
+			b.WriteString(formula[i:j])
+			i = j
+
+		case ch == '[':
+			// структурированная ссылка или ссылка на другую книгу
+			j := strings.IndexByte(formula[i:], ']')
+			if j < 0 {
+				j = len(formula) - i - 1
+			}
+			b.WriteString(formula[i : i+j+1])
+			i += j + 1
+
+		case isRefChar(ch):
+			j := scanRef(formula, i)
+			if j < len(formula) && formula[j] == '!' {
+				b.WriteString(formula[i : j+1])
+				i = shiftRef(&b, formula, j+1, isTarget(formula[i:j], sheet), sh, cols)
+				continue
+			}
+			i = shiftRef(&b, formula, i, local, sh, cols)
+
+		default:
+			b.WriteByte(ch)
+			i++
+		}
+	}
+
+	return b.String()
+}
+
+// shiftRef writes reference what starts at i, moved if it points at the
+// sheet. Returns position after the reference.
+func shiftRef(b *strings.Builder, formula string, i int, target bool, sh rowMapper, cols bool) int {
+
+	j := scanRef(formula, i)
+	first := formula[i:j]
+
+	if j < len(formula) && formula[j] == '(' {
+		// имя функции
+		b.WriteString(first)
+		return j
+	}
+
+	second := ""
+	end := j
+	if j < len(formula) && formula[j] == ':' {
+		k := scanRef(formula, j+1)
+		second = formula[j+1 : k]
+		end = k
+	}
+
+	// ссылка на ячейку или область ячеек
+	if m1 := cellRef.FindStringSubmatch(first); m1 != nil {
+		if !target {
+			if second != "" && cellRef.MatchString(second) {
+				j = end
+			}
+			b.WriteString(formula[i:j])
+			return j
+		}
+
+		if cols {
+			return shiftColRef(b, formula, i, j, end, second, m1, sh)
+		}
+
+		top, _ := strconv.Atoi(m1[3])
+		if second == "" {
+			r, ok := sh.row(top-1, m1[2] != "")
+			if !ok {
+				b.WriteString("#REF!")
+				return j
+			}
+			b.WriteString(m1[1] + m1[2] + strconv.Itoa(r+1))
+			return j
+		}
+
+		m2 := cellRef.FindStringSubmatch(second)
+		if m2 == nil {
+			b.WriteString(first)
+			return j
+		}
+
+		bottom, _ := strconv.Atoi(m2[3])
+		t, bt, ok := sh.area(top-1, bottom-1, m1[2] != "", m2[2] != "")
+		if !ok {
+			b.WriteString("#REF!")
+			return end
+		}
+		b.WriteString(m1[1] + m1[2] + strconv.Itoa(t+1) + ":" + m2[1] + m2[2] + strconv.Itoa(bt+1))
+		return end
+	}
+
+	// область целых строк, например 3:5
+	if m1 := rowRef.FindStringSubmatch(first); m1 != nil && second != "" {
+		m2 := rowRef.FindStringSubmatch(second)
+		if m2 == nil || !target || cols {
+			b.WriteString(formula[i:end])
+			return end
+		}
+
+		top, _ := strconv.Atoi(m1[2])
+		bottom, _ := strconv.Atoi(m2[2])
+		t, bt, ok := sh.area(top-1, bottom-1, m1[1] != "", m2[1] != "")
+		if !ok {
+			b.WriteString("#REF!")
+			return end
+		}
+		b.WriteString(m1[1] + strconv.Itoa(t+1) + ":" + m2[1] + strconv.Itoa(bt+1))
+		return end
+	}
+
+	// область целых столбцов, например A:C
+	if m1 := colRef.FindStringSubmatch(first); m1 != nil && second != "" {
+		m2 := colRef.FindStringSubmatch(second)
+		if m2 == nil || !target || !cols {
+			b.WriteString(formula[i:end])
+			return end
+		}
+
+		l, r, ok := sh.area(xlsx.ColLettersToIndex(m1[2]), xlsx.ColLettersToIndex(m2[2]), m1[1] != "", m2[1] != "")
+		if !ok {
+			b.WriteString("#REF!")
+			return end
+		}
+		b.WriteString(m1[1] + xlsx.ColIndexToLetters(l) + ":" + m2[1] + xlsx.ColIndexToLetters(r))
+		return end
+	}
+
+	b.WriteString(first)
+	return j
+}
+
+// shiftColRef writes moved columns of the cell reference formula[i:j] or of
+// the area formula[i:end] what ends by the cell second, m is the match of
+// the first cell.
+func shiftColRef(b *strings.Builder, formula string, i, j, end int, second string, m []string, sh rowMapper) int {
+
+	abs := strings.HasPrefix(m[1], "$")
+	left := xlsx.ColLettersToIndex(strings.TrimPrefix(m[1], "$"))
+
+	if second == "" {
+		c, ok := sh.row(left, abs)
+		if !ok {
+			b.WriteString("#REF!")
+			return j
+		}
+		b.WriteString(colLetters(c, abs) + m[2] + m[3])
+		return j
+	}
+
+	m2 := cellRef.FindStringSubmatch(second)
+	if m2 == nil {
+		b.WriteString(formula[i:j])
+		return j
+	}
+
+	abs2 := strings.HasPrefix(m2[1], "$")
+	right := xlsx.ColLettersToIndex(strings.TrimPrefix(m2[1], "$"))
+
+	l, r, ok := sh.area(left, right, abs, abs2)
+	if !ok {
+		b.WriteString("#REF!")
+		return end
+	}
+	b.WriteString(colLetters(l, abs) + m[2] + m[3] + ":" + colLetters(r, abs2) + m2[2] + m2[3])
+	return end
+}
+
+// colLetters returns letters of the column c, absolute column gets $.
+func colLetters(c int, abs bool) string {
+	if abs {
+		return "$" + xlsx.ColIndexToLetters(c)
+	}
+	return xlsx.ColIndexToLetters(c)
+}
+
+// isTarget tells if the sheet name of the reference is the sheet.
+func isTarget(name, sheet string) bool {
+	return sheet == "" || strings.EqualFold(name, sheet)
+}
+
+// skipQuoted returns position after the quoted text what starts at i.
+// Quote inside of the text is doubled.
+func skipQuoted(s string, i int) int {
+	q := s[i]
+	for j := i + 1; j < len(s); j++ {
+		if s[j] != q {
+			continue
+		}
+		if j+1 < len(s) && s[j+1] == q {
+			j++
+			continue
+		}
+		return j + 1
+	}
+	return len(s)
+}
+
+// scanRef returns end of the name or the reference what starts at i.
+func scanRef(s string, i int) int {
+	for i < len(s) && isRefChar(s[i]) {
+		i++
+	}
+	return i
+}
+
+func isRefChar(ch byte) bool {
+	return ch >= 'A' && ch <= 'Z' || ch >= 'a' && ch <= 'z' || ch >= '0' && ch <= '9' ||
+		ch == '$' || ch == '_' || ch == '.' || ch >= 0x80
+}
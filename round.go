@@ -0,0 +1,199 @@
+package rbuilder
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+// RoundMode tells how the value is rounded to the precision.
+type RoundMode int
+
+const (
+	// RoundHalfUp rounds half away from zero: 2.5 -> 3, -2.5 -> -3.
+	RoundHalfUp RoundMode = iota
+	// RoundHalfEven is banker's rounding, half goes to even digit:
+	// 2.5 -> 2, 3.5 -> 4.
+	RoundHalfEven
+	// RoundDown drops extra digits: 2.9 -> 2, -2.9 -> -2.
+	RoundDown
+	// RoundUp rounds away from zero: 2.1 -> 3, -2.1 -> -3.
+	RoundUp
+	// RoundFloor rounds toward negative infinity: 2.9 -> 2, -2.1 -> -3.
+	RoundFloor
+	// RoundCeil rounds toward positive infinity: 2.1 -> 3, -2.9 -> -2.
+	RoundCeil
+)
+
+// roundModes are names of modes for template functions.
+var roundModes = map[string]RoundMode{
+	"halfup":   RoundHalfUp,
+	"halfeven": RoundHalfEven,
+	"down":     RoundDown,
+	"up":       RoundUp,
+	"floor":    RoundFloor,
+	"ceil":     RoundCeil,
+}
+
+// parseRoundMode returns mode by the name, def if name is not set.
+func parseRoundMode(def RoundMode, name ...string) (RoundMode, error) {
+	if len(name) == 0 || name[0] == "" {
+		return def, nil
+	}
+	if len(name) > 1 {
+		return 0, fmt.Errorf("only one round mode is expected, got %d", len(name))
+	}
+	m, ok := roundModes[name[0]]
+	if !ok {
+		return 0, fmt.Errorf("unknown round mode %q", name[0])
+	}
+	return m, nil
+}
+
+// Round rounds v to decimals digits after the point, negative decimals
+// round to tens, hundreds and so on. v is rounded as the shortest decimal
+// number what is printed for it, so 1.005 is rounded to 1.01 although
+// float64 keeps it as 1.00499999999999989... Large values do not overflow.
+func Round(v float64, decimals int, mode RoundMode) float64 {
+
+	if math.IsInf(v, 0) || math.IsNaN(v) || v == 0 {
+		return v
+	}
+
+	f, _ := roundRat(decimalRat(v), decimals, mode).Float64()
+	return f
+}
+
+// decimalRat returns exact value of the shortest decimal representation
+// of v.
+func decimalRat(v float64) *big.Rat {
+	r, ok := new(big.Rat).SetString(strconv.FormatFloat(v, 'g', -1, 64))
+	if !ok {
+		return new(big.Rat)
+	}
+	return r
+}
+
+// roundRat rounds r to decimals digits after the point.
+func roundRat(r *big.Rat, decimals int, mode RoundMode) *big.Rat {
+
+	pow := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(absInt(decimals))), nil)
+
+	x := new(big.Rat).Set(r)
+	if decimals >= 0 {
+		x.Mul(x, new(big.Rat).SetInt(pow))
+	} else {
+		x.Quo(x, new(big.Rat).SetInt(pow))
+	}
+
+	// частное с отбрасыванием дробной части и остаток
+	q, rem := new(big.Int).QuoRem(x.Num(), x.Denom(), new(big.Int))
+
+	if rem.Sign() != 0 {
+		sign := int64(x.Sign())
+
+		// сравнение остатка с половиной
+		half := new(big.Int).Abs(rem)
+		half.Lsh(half, 1)
+		cmp := half.Cmp(x.Denom())
+
+		away := false
+		switch mode {
+		case RoundHalfUp:
+			away = cmp >= 0
+		case RoundHalfEven:
+			away = cmp > 0 || cmp == 0 && q.Bit(0) == 1
+		case RoundUp:
+			away = true
+		case RoundFloor:
+			away = sign < 0
+		case RoundCeil:
+			away = sign > 0
+		}
+
+		if away {
+			q.Add(q, big.NewInt(sign))
+		}
+	}
+
+	res := new(big.Rat).SetInt(q)
+	if decimals >= 0 {
+		return res.Quo(res, new(big.Rat).SetInt(pow))
+	}
+	return res.Mul(res, new(big.Rat).SetInt(pow))
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// roundFunc is {{round .D.Price 2}}: value rounded to the precision,
+// optional last argument is the round mode like "halfeven".
+func roundFunc(def RoundMode) func(v interface{}, decimals int, mode ...string) (float64, error) {
+	return func(v interface{}, decimals int, mode ...string) (float64, error) {
+		f, err := toFloat(v)
+		if err != nil {
+			return 0, err
+		}
+		m, err := parseRoundMode(def, mode...)
+		if err != nil {
+			return 0, err
+		}
+		return Round(f, decimals, m), nil
+	}
+}
+
+// Арифметика шаблонов выполняется над десятичными значениями, которые
+// печатаются для чисел, поэтому 0.1 + 0.2 дает 0.3.
+
+// addFunc is {{add .D.Price .D.Tax}}: exact decimal sum of the values.
+func addFunc(v interface{}, more ...interface{}) (float64, error) {
+	return decimalOp(v, more, func(a, b *big.Rat) (*big.Rat, error) { return a.Add(a, b), nil })
+}
+
+// subFunc is {{sub .D.Total .D.Paid}}: exact decimal difference.
+func subFunc(a, b interface{}) (float64, error) {
+	return decimalOp(a, []interface{}{b}, func(a, b *big.Rat) (*big.Rat, error) { return a.Sub(a, b), nil })
+}
+
+// mulFunc is {{mul .D.Price .D.Count}}: exact decimal product.
+func mulFunc(v interface{}, more ...interface{}) (float64, error) {
+	return decimalOp(v, more, func(a, b *big.Rat) (*big.Rat, error) { return a.Mul(a, b), nil })
+}
+
+// divFunc is {{div .D.Total .D.Count}}: quotient of the decimal values.
+func divFunc(a, b interface{}) (float64, error) {
+	return decimalOp(a, []interface{}{b}, func(a, b *big.Rat) (*big.Rat, error) {
+		if b.Sign() == 0 {
+			return nil, errors.New("div: division by zero")
+		}
+		return a.Quo(a, b), nil
+	})
+}
+
+// decimalOp applies op to the values from the left to the right.
+func decimalOp(v interface{}, more []interface{}, op func(a, b *big.Rat) (*big.Rat, error)) (float64, error) {
+
+	f, err := toFloat(v)
+	if err != nil {
+		return 0, err
+	}
+	res := decimalRat(f)
+
+	for _, m := range more {
+		if f, err = toFloat(m); err != nil {
+			return 0, err
+		}
+		if res, err = op(res, decimalRat(f)); err != nil {
+			return 0, err
+		}
+	}
+
+	f, _ = res.Float64()
+	return f, nil
+}
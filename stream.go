@@ -0,0 +1,524 @@
+package rbuilder
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tealeg/xlsx"
+)
+
+// Iterator is a source of range elements what are produced one by one, for
+// example rows of a database query. Next returns io.EOF when there are no
+// more elements.
+type Iterator interface {
+	Next() (interface{}, error)
+}
+
+// RenderStream renders the template and writes xlsx file straight to w.
+// Top level {{range}}{{end.}} block what iterates over a channel or an
+// Iterator is not kept in memory: rows of every element are written as soon
+// as the element is rendered. Rows above and below of the block, styles and
+// column widths are taken from the template as by Render.
+//
+// Only one such block per sheet is streamed, {{range}}{{endcol.}} cells,
+// {{mergeSame}} and style directives like {{color}} inside of it are not
+// supported, style table is written before the block. Number of streamed
+// rows is not known while other sheets, rows above of the block and rows of
+// the block itself are written, so their references to rows below of the
+// block are not moved.
+//
+// If an element fails, RenderStream returns the error without receiving
+// the rest of elements: the producer of the channel stays blocked on send
+// unless it can be cancelled, see RenderStreamContext. w holds partial
+// output in that case and should be discarded.
+func (p *Prepared) RenderStream(w io.Writer, data interface{}) error {
+	return p.RenderStreamContext(context.Background(), w, data)
+}
+
+// RenderStreamContext is RenderStream what stops receiving elements of
+// streamed blocks with ctx.Err() when ctx is done. The producer of the
+// channel should watch the same ctx and the caller should cancel it when
+// RenderStreamContext returns, so the producer is not left blocked after
+// an error.
+func (p *Prepared) RenderStreamContext(ctx context.Context, w io.Writer, data interface{}) (err error) {
+
+	defer func() { logResult(p.logger, "stream render", err) }()
+	defer recoverError(&err)
+
+	result := cloneFile(p.tmpl)
+
+	rr := &renderer{
+		report:  result,
+		data:    renderData{D: data, S: p.staticData, R: &renderState{}},
+		cols:    make(map[*xlsx.Cell][]colValue),
+		stream:  true,
+		ctx:     ctx,
+		log:     p.logger,
+		locale:  p.locale,
+		refs:    p.refs,
+		autoFit: p.autoFit,
+	}
+
+	if err := rr.render(p.model); err != nil {
+		return err
+	}
+
+	return rr.writeStream(w)
+}
+
+// streamBlock is top level block what is written by RenderStream.
+type streamBlock struct {
+	sheet int
+	// first is the first row of the band, its index is changed while
+	// blocks above are rendered
+	first *xlsx.Row
+	block *tmplBlock
+	value interface{}
+	// dates are copies of band rows with formats of dates, they are
+	// marshalled below of the sheet rows to get styles for cells what
+	// get dates while the block is written
+	dates []dateRow
+}
+
+// dateRow is the copy of the band row where every cell has format.
+type dateRow struct {
+	band   *xlsx.Row
+	format string
+	row    *xlsx.Row
+}
+
+// at returns index of the first row of the block in the sheet, -1 if the
+// row is lost.
+func (sb *streamBlock) at(sheet *xlsx.Sheet) int {
+	for r, row := range sheet.Rows {
+		if row == sb.first {
+			return r
+		}
+	}
+	return -1
+}
+
+// addDates appends copies of band rows with formats of dates to the sheet.
+func (sb *streamBlock) addDates(sheet *xlsx.Sheet) {
+
+	at := sb.at(sheet)
+	if at < 0 {
+		return
+	}
+
+	for _, band := range sheet.Rows[at : at+sb.block.height] {
+		for _, format := range []string{defaultDateFormat, defaultDateTimeFormat} {
+			row := sheet.AddRow()
+			for _, cell := range band.Cells {
+				tmp := new(xlsx.Cell)
+				*tmp = *cell
+				tmp.Row = row
+				tmp.HMerge, tmp.VMerge = 0, 0
+				tmp.NumFmt = format
+				row.Cells = append(row.Cells, tmp)
+			}
+			sb.dates = append(sb.dates, dateRow{band: band, format: format, row: row})
+		}
+	}
+}
+
+// isStream reports whether the range value is received element by element.
+func isStream(v interface{}) bool {
+	if _, ok := v.(Iterator); ok {
+		return true
+	}
+
+	val := reflect.ValueOf(v)
+	for val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface {
+		if val.IsNil() {
+			return false
+		}
+		val = val.Elem()
+	}
+
+	return val.Kind() == reflect.Chan
+}
+
+// deferBlock leaves rows of block b unrendered, they are written by
+// writeStream.
+func (rr *renderer) deferBlock(s int, b *tmplBlock, at int, v interface{}) error {
+
+	for _, sb := range rr.streams {
+		if sb.sheet == s {
+			return b.loc.error(ExecError, errors.New("only one streamed {{range}} per sheet is supported"))
+		}
+	}
+
+	rr.streams = append(rr.streams, &streamBlock{
+		sheet: s,
+		first: rr.report.Sheets[s].Rows[at],
+		block: b,
+		value: v,
+	})
+
+	return nil
+}
+
+// xmlSheet holds attributes of rows and cells of marshalled sheet what can
+// not be read from xlsx.Row and xlsx.Cell.
+type xmlSheet struct {
+	Rows []*xmlRow `xml:"sheetData>row"`
+}
+
+type xmlRow struct {
+	Hidden       bool   `xml:"hidden,attr"`
+	Ht           string `xml:"ht,attr"`
+	CustomHeight bool   `xml:"customHeight,attr"`
+	OutlineLevel uint8  `xml:"outlineLevel,attr"`
+	Cells        []struct {
+		S int `xml:"s,attr"`
+	} `xml:"c"`
+}
+
+var (
+	dimensionTag  = regexp.MustCompile(`<dimension[^>]*?(/>|>\s*</dimension>)`)
+	mergeCellsTag = regexp.MustCompile(`(?s)<mergeCells[^>]*?(/>|>.*?</mergeCells>)`)
+)
+
+// writeStream writes the rendered workbook to w. Sheets with streamed
+// blocks are written row by row.
+func (rr *renderer) writeStream(w io.Writer) error {
+
+	// стили ячеек с датами должны попасть в таблицу стилей до ее записи
+	for _, sb := range rr.streams {
+		sb.addDates(rr.report.Sheets[sb.sheet])
+	}
+
+	parts, err := rr.report.MarshallParts()
+	if err != nil {
+		return err
+	}
+
+	for _, sb := range rr.streams {
+		sheet := rr.report.Sheets[sb.sheet]
+		sheet.Rows = sheet.Rows[:len(sheet.Rows)-len(sb.dates)]
+		sheet.MaxRow = len(sheet.Rows)
+	}
+
+	streamed := make(map[string]*streamBlock)
+	for _, sb := range rr.streams {
+		streamed[fmt.Sprintf("xl/worksheets/sheet%d.xml", sb.sheet+1)] = sb
+	}
+
+	names := make([]string, 0, len(parts))
+	for name := range parts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	zw := zip.NewWriter(w)
+
+	for _, name := range names {
+		if _, ok := streamed[name]; ok {
+			continue
+		}
+		pw, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(pw, parts[name]); err != nil {
+			return err
+		}
+	}
+
+	// листы с потоковыми блоками записываются последними
+	for _, name := range names {
+		sb, ok := streamed[name]
+		if !ok {
+			continue
+		}
+		pw, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		if err := rr.writeSheet(pw, parts[name], sb); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+// sheetWriter writes rows of the sheet XML. Row and cell attributes are
+// taken from the marshalled rows of the template.
+type sheetWriter struct {
+	w *bufio.Writer
+	// attrs maps rows of the rendered sheet to their marshalled attributes
+	attrs  map[*xlsx.Row]*xmlRow
+	origin map[*xlsx.Row]*xlsx.Row
+	// r is the index of the next row in the output
+	r      int
+	merges []string
+	// heights are heights of streamed rows set by WithAutoFitRows
+	heights map[*xlsx.Row]float64
+	// dates maps band rows and formats of dates to attributes of their
+	// copies with the format
+	dates map[*xlsx.Row]map[string]*xmlRow
+}
+
+// writeSheet writes sheet XML part what is marshalled as part. Rows of the
+// streamed block are rendered element by element and replace the band of
+// the block.
+func (rr *renderer) writeSheet(w io.Writer, part string, sb *streamBlock) error {
+
+	sheet := rr.report.Sheets[sb.sheet]
+
+	start := strings.Index(part, "<sheetData>")
+	end := strings.Index(part, "</sheetData>")
+	if start < 0 || end < 0 {
+		return fmt.Errorf("sheet %s: unexpected sheet XML", sheet.Name)
+	}
+
+	var xs xmlSheet
+	if err := xml.Unmarshal([]byte(part), &xs); err != nil {
+		return err
+	}
+	n := len(sheet.Rows)
+	if len(xs.Rows) != n+len(sb.dates) {
+		return fmt.Errorf("sheet %s: unexpected sheet XML", sheet.Name)
+	}
+
+	at := sb.at(sheet)
+	if at < 0 {
+		return errors.New("streamed block is lost")
+	}
+
+	sw := &sheetWriter{
+		w:     bufio.NewWriter(w),
+		attrs: make(map[*xlsx.Row]*xmlRow, n),
+		dates: make(map[*xlsx.Row]map[string]*xmlRow),
+	}
+	for r, row := range sheet.Rows {
+		sw.attrs[row] = xs.Rows[r]
+	}
+	for i, d := range sb.dates {
+		if sw.dates[d.band] == nil {
+			sw.dates[d.band] = make(map[string]*xmlRow)
+		}
+		sw.dates[d.band][d.format] = xs.Rows[n+i]
+	}
+
+	// размер листа заранее неизвестен, тэг dimension не обязателен
+	prefix := dimensionTag.ReplaceAllString(part[:start+len("<sheetData>")], "")
+	sw.w.WriteString(prefix)
+
+	for _, row := range sheet.Rows[:at] {
+		sw.writeRow(row)
+	}
+
+	h := sb.block.height
+	band := sheet.Rows[at : at+h]
+
+	// строки элемента формируются на отдельном листе из копий строк
+	// шаблона и после записи больше не нужны
+	scratch := xlsx.NewFile()
+	if _, err := scratch.AddSheet(sheet.Name); err != nil {
+		return err
+	}
+
+	er := &renderer{
+		report: scratch,
+		data:   rr.data,
+		cols:   make(map[*xlsx.Cell][]colValue),
+		log:    rr.log,
+		locale: rr.locale,
+		refs:   rr.refs,
+	}
+
+	st := rr.data.R
+	err := eachFrame(rr.ctx, sb.value, func(frame interface{}) error {
+
+		er.origin = make(map[*xlsx.Row]*xlsx.Row, h)
+		er.totals = nil
+		sw.origin = er.origin
+		for _, row := range band {
+			er.origin[row] = row
+		}
+
+		st.frames = append(st.frames, frame)
+		elem, _, err := er.renderElem(0, sb.block, band, at)
+		st.frames = st.frames[:len(st.frames)-1]
+		if err != nil {
+			return err
+		}
+
+		er.fixTotals(elem)
+
+		if len(er.cols) > 0 {
+			return sb.block.loc.error(ExecError, fmt.Errorf("{{range}}%s inside of streamed {{range}} is not supported", colEndTag))
+		}
+
+		// строки элемента не хранятся, объединять их со следующими нечем
+		if len(er.same) > 0 {
+			return sb.block.loc.error(ExecError, errors.New("{{mergeSame}} inside of streamed {{range}} is not supported"))
+		}
+
+		// таблица стилей уже записана, новый стиль в нее не попадет
+		if len(er.styles) > 0 {
+			return sb.block.loc.error(ExecError, errors.New("style directives inside of streamed {{range}} are not supported"))
+		}
+
+		// формулы элемента ссылаются на его строки вывода
+		sh := bandShift{at: at, height: len(elem), inside: true, delta: sw.r - at}
+		sw.heights = make(map[*xlsx.Row]float64)
+		for _, row := range elem {
+			if er.refs {
+				shiftCells(row, sheet.Name, true, sh)
+			}
+			// ширина колонок берется из листа шаблона
+			if rr.autoFit && fitRow(sheet, row) {
+				sw.heights[row] = row.Height
+			}
+			sw.writeRow(row)
+		}
+
+		return sw.w.Flush()
+	})
+	if err != nil {
+		return sb.block.loc.error(ExecError, err)
+	}
+
+	rr.log.Debug("stream range", "sheet", sheet.Name, "row", at, "rows", sw.r-at)
+
+	// итоги под блоком охватывают все записанные строки
+	var sh rowMapper = bandShift{at: at, height: h, ins: sw.r - at - h}
+	if sw.r-at < h {
+		sh = rowShift{at: sw.r, cnt: sw.r - at - h}
+	}
+
+	for _, row := range sheet.Rows[at+h:] {
+		if rr.refs {
+			shiftCells(row, sheet.Name, true, sh)
+		}
+	}
+	rr.fixTotals(sheet.Rows[at+h:])
+
+	for _, row := range sheet.Rows[at+h:] {
+		sw.writeRow(row)
+	}
+
+	// объединения ячеек пересчитаны для строк вывода
+	suffix := mergeCellsTag.ReplaceAllString(part[end:], "")
+	if len(sw.merges) > 0 {
+		idx := strings.Index(suffix, "<printOptions")
+		if idx < 0 {
+			idx = strings.Index(suffix, "</worksheet>")
+		}
+		merges := fmt.Sprintf(`<mergeCells count="%d">`, len(sw.merges))
+		for _, ref := range sw.merges {
+			merges += `<mergeCell ref="` + ref + `"></mergeCell>`
+		}
+		suffix = suffix[:idx] + merges + "</mergeCells>" + suffix[idx:]
+	}
+	sw.w.WriteString(suffix)
+
+	return sw.w.Flush()
+}
+
+// writeRow writes the row as the next row of the output.
+func (sw *sheetWriter) writeRow(row *xlsx.Row) {
+
+	band := row
+	attrs, ok := sw.attrs[row]
+	if !ok {
+		band = sw.origin[row]
+		attrs = sw.attrs[band]
+	}
+	if attrs == nil {
+		attrs = &xmlRow{}
+	}
+
+	w := sw.w
+	w.WriteString(`<row r="` + strconv.Itoa(sw.r+1) + `"`)
+	if attrs.Hidden {
+		w.WriteString(` hidden="1"`)
+	}
+	if ht, ok := sw.heights[row]; ok {
+		w.WriteString(` ht="` + strconv.FormatFloat(ht, 'g', -1, 64) + `" customHeight="1"`)
+	} else if attrs.CustomHeight {
+		w.WriteString(` ht="` + attrs.Ht + `" customHeight="1"`)
+	}
+	if attrs.OutlineLevel > 0 {
+		w.WriteString(` outlineLevel="` + strconv.Itoa(int(attrs.OutlineLevel)) + `"`)
+	}
+	w.WriteString(">")
+
+	for c, cell := range row.Cells {
+		ref := xlsx.GetCellIDStringFromCoords(c, sw.r)
+
+		s := 0
+		if c < len(attrs.Cells) {
+			s = attrs.Cells[c].S
+		}
+		// ячейка получила формат даты, стиль берется из копии строки
+		if d := sw.dates[band][cell.NumFmt]; d != nil && c < len(d.Cells) && c < len(band.Cells) && band.Cells[c].NumFmt != cell.NumFmt {
+			s = d.Cells[c].S
+		}
+
+		w.WriteString(`<c r="` + ref + `"`)
+		if s != 0 {
+			w.WriteString(` s="` + strconv.Itoa(s) + `"`)
+		}
+
+		var t string
+		switch cell.Type() {
+		case xlsx.CellTypeString, xlsx.CellTypeInline:
+			if cell.Value != "" {
+				t = "inlineStr"
+			}
+		case xlsx.CellTypeBool:
+			t = "b"
+		case xlsx.CellTypeError:
+			t = "e"
+		case xlsx.CellTypeDate:
+			t = "d"
+		case xlsx.CellTypeStringFormula:
+			t = "str"
+		}
+		if t != "" {
+			w.WriteString(` t="` + t + `"`)
+		}
+		w.WriteString(">")
+
+		if f := cell.Formula(); f != "" {
+			w.WriteString("<f>")
+			xml.EscapeText(w, []byte(f))
+			w.WriteString("</f>")
+		}
+
+		switch {
+		case t == "inlineStr":
+			w.WriteString(`<is><t xml:space="preserve">`)
+			xml.EscapeText(w, []byte(cell.Value))
+			w.WriteString("</t></is>")
+		case cell.Value != "":
+			w.WriteString("<v>")
+			xml.EscapeText(w, []byte(cell.Value))
+			w.WriteString("</v>")
+		}
+
+		w.WriteString("</c>")
+
+		if cell.HMerge > 0 || cell.VMerge > 0 {
+			sw.merges = append(sw.merges, ref+":"+xlsx.GetCellIDStringFromCoords(c+cell.HMerge, sw.r+cell.VMerge))
+		}
+	}
+
+	w.WriteString("</row>")
+	sw.r++
+}
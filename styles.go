@@ -0,0 +1,163 @@
+package rbuilder
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tealeg/xlsx"
+)
+
+// Директивы стиля меняют оформление ячейки в зависимости от данных:
+// {{if lt .D.Balance 0.0}}{{color "red"}}{{end}}{{.D.Balance}}
+
+const styleDirective = "style"
+
+// colorNames are colors what can be set by the name.
+var colorNames = map[string]string{
+	"black":  "FF000000",
+	"white":  "FFFFFFFF",
+	"red":    "FFFF0000",
+	"green":  "FF00B050",
+	"blue":   "FF0070C0",
+	"yellow": "FFFFFF00",
+	"orange": "FFFFC000",
+	"gray":   "FF808080",
+}
+
+// borderStyles are styles of the cell border.
+var borderStyles = map[string]bool{
+	"thin": true, "medium": true, "thick": true, "dashed": true, "dotted": true,
+	"double": true, "hair": true, "none": true,
+}
+
+// parseColor returns ARGB color of Excel by the name, like "red", or by
+// hex RGB or ARGB value, like "#FF0000".
+func parseColor(s string) (string, error) {
+
+	if c, ok := colorNames[strings.ToLower(s)]; ok {
+		return c, nil
+	}
+
+	c := strings.ToUpper(strings.TrimPrefix(s, "#"))
+	if strings.Trim(c, "0123456789ABCDEF") != "" {
+		return "", fmt.Errorf("invalid color %q", s)
+	}
+
+	switch len(c) {
+	case 6:
+		return "FF" + c, nil
+	case 8:
+		return c, nil
+	}
+
+	return "", fmt.Errorf("invalid color %q", s)
+}
+
+// colorFunc is {{color "red"}}: color of the cell font.
+func colorFunc(st *renderState, color string) (string, error) {
+	c, err := parseColor(color)
+	if err != nil {
+		return "", fmt.Errorf("color: %v", err)
+	}
+	st.directive(styleDirective, "color", c)
+	return "", nil
+}
+
+// fillFunc is {{fill "#FFFF00"}}: solid background of the cell.
+func fillFunc(st *renderState, color string) (string, error) {
+	c, err := parseColor(color)
+	if err != nil {
+		return "", fmt.Errorf("fill: %v", err)
+	}
+	st.directive(styleDirective, "fill", c)
+	return "", nil
+}
+
+// boldFunc is {{bold}}: bold font of the cell.
+func boldFunc(st *renderState) string {
+	st.directive(styleDirective, "bold")
+	return ""
+}
+
+// borderFunc is {{border "thin"}} or {{border "thin" "red"}}: border around
+// the cell.
+func borderFunc(st *renderState, style string, color ...string) (string, error) {
+
+	if !borderStyles[style] {
+		return "", fmt.Errorf("border: invalid style %q", style)
+	}
+
+	c := ""
+	switch len(color) {
+	case 0:
+	case 1:
+		var err error
+		if c, err = parseColor(color[0]); err != nil {
+			return "", fmt.Errorf("border: %v", err)
+		}
+	default:
+		return "", fmt.Errorf("border: only one color is expected, got %d", len(color))
+	}
+
+	st.directive(styleDirective, "border", style, c)
+	return "", nil
+}
+
+// styleKey identifies style what is made from the base style by changes.
+type styleKey struct {
+	base    *xlsx.Style
+	changes string
+}
+
+// restyle sets the copy of the cell style with changes of style directives.
+// Style of the template is shared by many cells, so it is not modified.
+// Cells with the same changes share the new style, style table of the
+// workbook gets single entry for them when the workbook is written.
+func (rr *renderer) restyle(cell *xlsx.Cell, changes []string) error {
+
+	base := cell.GetStyle()
+	key := styleKey{base: base, changes: strings.Join(changes, ";")}
+
+	if st, ok := rr.styles[key]; ok {
+		cell.SetStyle(st)
+		return nil
+	}
+
+	st := *base
+	for _, ch := range changes {
+		args := strings.Split(ch, ":")
+		switch args[0] {
+		case "color":
+			st.Font.Color = args[1]
+			st.ApplyFont = true
+		case "bold":
+			st.Font.Bold = true
+			st.ApplyFont = true
+		case "fill":
+			st.Fill = xlsx.Fill{PatternType: "solid", FgColor: args[1], BgColor: args[1]}
+			st.ApplyFill = true
+		case "border":
+			if len(args) != 3 {
+				return errors.New("invalid border directive")
+			}
+			st.Border = xlsx.Border{
+				Left: args[1], LeftColor: args[2],
+				Right: args[1], RightColor: args[2],
+				Top: args[1], TopColor: args[2],
+				Bottom: args[1], BottomColor: args[2],
+			}
+			st.ApplyBorder = true
+		default:
+			return fmt.Errorf("unknown style %q", args[0])
+		}
+	}
+
+	if rr.styles == nil {
+		rr.styles = make(map[styleKey]*xlsx.Style)
+	}
+	rr.styles[key] = &st
+	cell.SetStyle(&st)
+
+	return nil
+}
@@ -1,7 +1,15 @@
 package rbuilder_test
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
 	"testing"
+	"text/template"
 
 	"time"
 
@@ -46,3 +54,1882 @@ func TestCloneSheet(t *testing.T) {
 	}
 
 }
+
+// newTemplateFile creates single sheet workbook where every element of rows
+// is a row of cells values.
+func newTemplateFile(t *testing.T, rows ...[]string) *xlsx.File {
+	f := xlsx.NewFile()
+	sheet, err := f.AddSheet("Sheet1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cells := range rows {
+		row := sheet.AddRow()
+		for _, val := range cells {
+			row.AddCell().SetString(val)
+		}
+	}
+
+	return f
+}
+
+// sheetValues returns values of the sheet cells as strings.
+func sheetValues(s *xlsx.Sheet) [][]string {
+	res := make([][]string, 0, len(s.Rows))
+	for _, row := range s.Rows {
+		vals := make([]string, 0, len(row.Cells))
+		for _, cell := range row.Cells {
+			vals = append(vals, cell.Value)
+		}
+		res = append(res, vals)
+	}
+	return res
+}
+
+func TestRenderMultiRowRange(t *testing.T) {
+
+	f := newTemplateFile(t,
+		[]string{"Protocol {{.D.ID}}", ""},
+		[]string{"{{range .D.Services}}{{.Name}}", "{{.Code}}"},
+		[]string{"Price", "{{.Price}}{{end.}}"},
+		[]string{"Total", "{{.D.Total}}"},
+	)
+
+	d := map[string]interface{}{
+		"ID":    "122/2016",
+		"Total": 500,
+		"Services": []map[string]interface{}{
+			{"Name": "Osmotr", "Code": "1.1", "Price": 170},
+			{"Name": "Plomba", "Code": "3.8", "Price": 330},
+		},
+	}
+
+	tmpl := rbuilder.NewTemplate(f, nil)
+
+	out, err := tmpl.Render(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{
+		{"Protocol 122/2016", ""},
+		{"Osmotr", "1.1"},
+		{"Price", "170"},
+		{"Plomba", "3.8"},
+		{"Price", "330"},
+		{"Total", "500"},
+	}
+
+	got := sheetValues(out.Sheets[0])
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	// empty range removes whole band
+	d["Services"] = []map[string]interface{}{}
+
+	out, err = tmpl.Render(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected = [][]string{
+		{"Protocol 122/2016", ""},
+		{"Total", "500"},
+	}
+
+	got = sheetValues(out.Sheets[0])
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestRenderRangeCellsAroundTags(t *testing.T) {
+
+	type service struct {
+		Name  string
+		Price int
+	}
+	services := []service{{"Osmotr", 170}, {"Plomba", 330}}
+
+	tests := []struct {
+		name     string
+		rows     [][]string
+		d        interface{}
+		expected [][]string
+	}{
+		{
+			"right of end",
+			[][]string{{"{{range .D}}{{.Name}}", ""}, {"{{.Price}}{{end.}}", "{{.Name}}"}},
+			services,
+			[][]string{{"Osmotr", ""}, {"170", "Osmotr"}, {"Plomba", ""}, {"330", "Plomba"}},
+		},
+		{
+			"left of range",
+			[][]string{{"{{.Name}}", "{{range .D}}{{.Price}}"}, {"", "{{.Price}}{{end.}}"}},
+			services,
+			[][]string{{"Osmotr", "170"}, {"", "170"}, {"Plomba", "330"}, {"", "330"}},
+		},
+		{
+			"dot right of end",
+			[][]string{{"{{range .D}}{{.}}", ""}, {"{{.}}{{end.}}", "{{.}}"}},
+			[]int{1, 2},
+			[][]string{{"1", ""}, {"1", "1"}, {"2", ""}, {"2", "2"}},
+		},
+	}
+
+	for _, tt := range tests {
+		tmpl := rbuilder.NewTemplate(newTemplateFile(t, tt.rows...), nil)
+
+		out, err := tmpl.Render(tt.d)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		got := sheetValues(out.Sheets[0])
+		if fmt.Sprint(got) != fmt.Sprint(tt.expected) {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestRenderNestedRange(t *testing.T) {
+
+	f := newTemplateFile(t,
+		[]string{"Protocol", ""},
+		[]string{"{{range .D.Teeth}}Tooth {{.Tooth}}", ""},
+		[]string{"{{range .Services}}{{.Name}}", "{{.Price}}{{end.}}"},
+		[]string{"Subtotal", "{{.Sum}}{{end.}}"},
+		[]string{"Total", "{{.D.Total}}"},
+	)
+
+	type service struct {
+		Name  string
+		Price int
+	}
+
+	type tooth struct {
+		Tooth    int
+		Services []service
+		Sum      int
+	}
+
+	d := map[string]interface{}{
+		"Total": 780,
+		"Teeth": []tooth{
+			{Tooth: 35, Services: []service{{"Raspl", 330}, {"Med", 280}}, Sum: 610},
+			{Tooth: 36},
+			{Tooth: 37, Services: []service{{"Osmotr", 170}}, Sum: 170},
+		},
+	}
+
+	tmpl := rbuilder.NewTemplate(f, nil)
+
+	out, err := tmpl.Render(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{
+		{"Protocol", ""},
+		{"Tooth 35", ""},
+		{"Raspl", "330"},
+		{"Med", "280"},
+		{"Subtotal", "610"},
+		{"Tooth 36", ""},
+		{"Subtotal", "0"},
+		{"Tooth 37", ""},
+		{"Osmotr", "170"},
+		{"Subtotal", "170"},
+		{"Total", "780"},
+	}
+
+	got := sheetValues(out.Sheets[0])
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestRenderColumnRange(t *testing.T) {
+
+	f := newTemplateFile(t,
+		[]string{"Report", "", ""},
+		[]string{"Product", "{{range .D.Months}}{{.}}{{endcol.}}", "Total"},
+		[]string{"{{range .D.Products}}{{.Name}}", "{{range .Values}}{{.}}{{endcol.}}", "{{.Total}}{{end.}}"},
+		[]string{"Sum", "", "{{.D.Sum}}"},
+	)
+
+	f.Sheets[0].Rows[0].Cells[0].Merge(2, 0)
+	if err := f.Sheets[0].SetColWidth(1, 1, 15); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sheets[0].SetColWidth(2, 2, 20); err != nil {
+		t.Fatal(err)
+	}
+
+	d := map[string]interface{}{
+		"Months": []string{"Jan", "Feb", "Mar"},
+		"Products": []map[string]interface{}{
+			{"Name": "A", "Values": []int{1, 2, 3}, "Total": 6},
+			{"Name": "B", "Values": []int{4, 5}, "Total": 9},
+		},
+		"Sum": 15,
+	}
+
+	tmpl := rbuilder.NewTemplate(f, nil)
+
+	out, err := tmpl.Render(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{
+		{"Report", "", "", "", ""},
+		{"Product", "Jan", "Feb", "Mar", "Total"},
+		{"A", "1", "2", "3", "6"},
+		{"B", "4", "5", "", "9"},
+		{"Sum", "", "", "", "15"},
+	}
+
+	sheet := out.Sheets[0]
+	got := sheetValues(sheet)
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	if sheet.Rows[0].Cells[0].HMerge != 4 {
+		t.Errorf("expected merge of 4 cells, got %d", sheet.Rows[0].Cells[0].HMerge)
+	}
+
+	for c, w := range []float64{15, 15, 15, 20} {
+		if sheet.Cols[c+1].Width != w {
+			t.Errorf("column %d: expected width %v, got %v", c+1, w, sheet.Cols[c+1].Width)
+		}
+	}
+
+	if err := out.Write(ioutil.Discard); err != nil {
+		t.Error(err)
+	}
+
+	// empty ranges remove the column
+	d["Months"] = []string{}
+	d["Products"] = []map[string]interface{}{}
+
+	out, err = tmpl.Render(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected = [][]string{
+		{"Report", ""},
+		{"Product", "Total"},
+		{"Sum", "15"},
+	}
+
+	got = sheetValues(out.Sheets[0])
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestRenderDataDoesNotBreakCells(t *testing.T) {
+
+	f := newTemplateFile(t,
+		[]string{"{{.D.Title}}", "{{range .D.Tags}}{{.}};{{end}}"},
+		[]string{"{{range $i, $g := .D.Groups}}{{$i}}", "{{$g.Name}}"},
+		[]string{"{{range .Items}}{{$g.Name}}", "{{.}}{{end.}}{{end.}}"},
+	)
+
+	type group struct {
+		Name  string
+		Items []string
+	}
+
+	d := map[string]interface{}{
+		"Title": "##0:0:1##<<1>>$$^~^$$",
+		"Tags":  []string{"<<", ">>"},
+		"Groups": []group{
+			{Name: "{{.D.Title}}", Items: []string{"##begin", "a<<0:1>>b"}},
+			{Name: "$$^|^$$", Items: []string{"##end"}},
+		},
+	}
+
+	tmpl := rbuilder.NewTemplate(f, nil)
+
+	out, err := tmpl.Render(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{
+		{"##0:0:1##<<1>>$$^~^$$", "<<;>>;"},
+		{"0", "{{.D.Title}}"},
+		{"{{.D.Title}}", "##begin"},
+		{"{{.D.Title}}", "a<<0:1>>b"},
+		{"1", "$$^|^$$"},
+		{"$$^|^$$", "##end"},
+	}
+
+	got := sheetValues(out.Sheets[0])
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestPreparedConcurrentRender(t *testing.T) {
+
+	f := newTemplateFile(t,
+		[]string{"Protocol {{.D.ID}}", "{{.S.Company}}"},
+		[]string{"{{range .D.Items}}{{.}}", "{{$.D.ID}}{{end.}}"},
+	)
+
+	tmpl := rbuilder.NewTemplate(f, map[string]string{"Company": "Elephant"})
+
+	p, err := tmpl.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// later changes of the template do not affect compiled one
+	f.Sheets[0].Rows[0].Cells[0].SetString("changed")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			items := make([]string, i%4)
+			for k := range items {
+				items[k] = fmt.Sprintf("item%d", k)
+			}
+
+			out, err := p.Render(map[string]interface{}{"ID": i, "Items": items})
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			expected := [][]string{{fmt.Sprintf("Protocol %d", i), "Elephant"}}
+			for _, item := range items {
+				expected = append(expected, []string{item, fmt.Sprint(i)})
+			}
+
+			if got := sheetValues(out.Sheets[0]); fmt.Sprint(got) != fmt.Sprint(expected) {
+				errs <- fmt.Errorf("expected %q, got %q", expected, got)
+			}
+
+			if err := out.Write(ioutil.Discard); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestCloneSheetDeepCopy(t *testing.T) {
+
+	f := newTemplateFile(t,
+		[]string{"{{range .D.Dyn0}}{{.}}{{end.}}", "{{$.D.Dyn0Name}}"},
+	)
+
+	if err := rbuilder.CloneSheet(f, 0, "Copy", "Dyn0", "Dyn1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rbuilder.CloneSheet(f, 2, "Wrong", "Dyn0", "Dyn1"); err == nil {
+		t.Error("expected error for invalid sheet index")
+	}
+
+	expected := [][]string{{"{{range .D.Dyn0}}{{.}}{{end.}}", "{{$.D.Dyn0Name}}"}}
+	if got := sheetValues(f.Sheets[0]); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("source sheet changed: %q", got)
+	}
+
+	d := map[string]interface{}{
+		"Dyn0": []int{1, 2}, "Dyn0Name": "first",
+		"Dyn1": []int{3}, "Dyn1Name": "second",
+	}
+
+	tmpl := rbuilder.NewTemplate(f, nil)
+
+	out, err := tmpl.Render(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected = [][]string{{"1", "first"}, {"2", "first"}}
+	if got := sheetValues(out.Sheet["Sheet1"]); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	expected = [][]string{{"3", "second"}}
+	if got := sheetValues(out.Sheet["Copy"]); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+type sliceIterator []interface{}
+
+func (it *sliceIterator) Next() (interface{}, error) {
+	if len(*it) == 0 {
+		return nil, io.EOF
+	}
+	e := (*it)[0]
+	*it = (*it)[1:]
+	return e, nil
+}
+
+func TestRenderStream(t *testing.T) {
+
+	f := newTemplateFile(t,
+		[]string{"Export {{.D.ID}}", ""},
+		[]string{"{{range $i, $r := .D.Rows}}{{$i}}", "{{$r.Name}}"},
+		[]string{"{{range $r.Items}}", "{{.}}{{end.}}{{end.}}"},
+		[]string{"Total", "{{.D.Total}}"},
+	)
+	sheet := f.Sheets[0]
+	sheet.Rows[1].Cells[1].GetStyle().Font.Bold = true
+	sheet.Rows[3].Cells[0].HMerge = 1
+	sheet.Col(1).Width = 30
+
+	tmpl := rbuilder.NewTemplate(f, nil)
+	p, err := tmpl.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type row struct {
+		Name  string
+		Items []string
+	}
+
+	rows := make(chan row)
+	go func() {
+		rows <- row{Name: "Alpha", Items: []string{"a1", "a2"}}
+		rows <- row{Name: "Beta"}
+		rows <- row{Name: "Gamma", Items: []string{"g1"}}
+		close(rows)
+	}()
+
+	buf := bytes.NewBuffer(nil)
+	if err := p.RenderStream(buf, map[string]interface{}{"ID": "07/2019", "Total": 3, "Rows": rows}); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := xlsx.OpenBinary(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{
+		{"Export 07/2019", ""},
+		{"0", "Alpha"},
+		{"", "a1"},
+		{"", "a2"},
+		{"1", "Beta"},
+		{"2", "Gamma"},
+		{"", "g1"},
+		{"Total", "3"},
+	}
+
+	got := sheetValues(out.Sheets[0])
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	for _, r := range []int{1, 4, 5} {
+		if !out.Sheets[0].Cell(r, 1).GetStyle().Font.Bold {
+			t.Errorf("row %d: style of the template is lost", r)
+		}
+	}
+
+	if out.Sheets[0].Cell(7, 0).HMerge != 1 {
+		t.Errorf("merge of the footer is not shifted")
+	}
+
+	if w := out.Sheets[0].Col(1).Width; w != 30 {
+		t.Errorf("expected column width 30, got %v", w)
+	}
+
+	// Iterator is streamed the same way
+	it := sliceIterator{row{Name: "Delta"}}
+	buf.Reset()
+	if err := p.RenderStream(buf, map[string]interface{}{"ID": "08/2019", "Total": 1, "Rows": &it}); err != nil {
+		t.Fatal(err)
+	}
+
+	if out, err = xlsx.OpenBinary(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected = [][]string{
+		{"Export 08/2019", ""},
+		{"0", "Delta"},
+		{"Total", "1"},
+	}
+
+	got = sheetValues(out.Sheets[0])
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestRenderStreamError(t *testing.T) {
+
+	tmpl := rbuilder.NewTemplate(newTemplateFile(t, []string{"{{range .D}}{{div 1 .}}{{end.}}"}), nil)
+	p, err := tmpl.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	produce := func(ctx context.Context, ch chan<- int, done chan<- struct{}) {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case ch <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+
+	// first element fails, producer is stopped by the caller
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan int)
+	done := make(chan struct{})
+	go produce(ctx, ch, done)
+
+	err = p.RenderStreamContext(ctx, ioutil.Discard, ch)
+	cancel()
+	if err == nil {
+		t.Error("expected error")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("producer is blocked")
+	}
+
+	// cancelled context stops receiving
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := p.RenderStreamContext(ctx, ioutil.Discard, make(chan int)); !strings.Contains(fmt.Sprint(err), context.Canceled.Error()) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestRenderStreamUnsupported(t *testing.T) {
+
+	tests := []struct {
+		name string
+		rows [][]string
+	}{
+		{"endcol", [][]string{{"{{range .D}}x"}, {"{{range .}}{{.}}{{endcol.}}{{end.}}"}}},
+		{"mergeSame", [][]string{{"{{range .D}}{{mergeSame}}{{index . 0}}{{end.}}"}}},
+		{"style", [][]string{{"{{range .D}}{{bold}}{{index . 0}}{{end.}}"}}},
+	}
+
+	for _, tt := range tests {
+		tmpl := rbuilder.NewTemplate(newTemplateFile(t, tt.rows...), nil)
+		p, err := tmpl.Compile()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		it := sliceIterator{[]string{"a"}, []string{"a"}}
+		if err := p.RenderStream(ioutil.Discard, &it); !strings.Contains(fmt.Sprint(err), "not supported") {
+			t.Errorf("%s: expected error, got %v", tt.name, err)
+		}
+	}
+}
+
+func TestRenderErrors(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		cells []string
+	}{
+		{"parse", []string{"{{.D.Name)}}"}},
+		{"unknown function", []string{"{{nope .D}}"}},
+		{"exec", []string{"{{index .D.List 5}}"}},
+		{"range", []string{"{{range .D.Name}}{{.}}{{end.}}"}},
+		{"unclosed range", []string{"{{range .D.List}}{{.}}"}},
+		{"end without range", []string{"{{.D.Name}}{{end.}}"}},
+	}
+
+	d := map[string]interface{}{"Name": "x", "List": []int{1}}
+
+	for _, tt := range tests {
+		tmpl := rbuilder.NewTemplate(newTemplateFile(t, tt.cells), nil)
+		if _, err := tmpl.Render(d); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+
+	var tmpl rbuilder.Template
+	if _, err := tmpl.Render(d); err == nil {
+		t.Errorf("expected error for empty template")
+	}
+}
+
+func TestRenderCellError(t *testing.T) {
+
+	tests := []struct {
+		cell string
+		kind rbuilder.ErrorKind
+		ref  string
+	}{
+		{"{{.D.Name)}}", rbuilder.ParseError, "B2"},
+		{"{{index .D.List 5}}", rbuilder.ExecError, "B2"},
+		{"{{.D.Missing}}", rbuilder.MissingKeyError, "B2"},
+		{"{{range .D.List}}{{.Missing}}{{end.}}", rbuilder.MissingKeyError, "B2"},
+		{"{{range .D.Missing}}{{.}}{{end.}}", rbuilder.MissingKeyError, "B2"},
+	}
+
+	d := map[string]interface{}{"Name": "x", "List": []map[string]int{{"A": 1}}}
+
+	for _, tt := range tests {
+		f := newTemplateFile(t, []string{"Header", "{{.D.Name}}"}, []string{"", tt.cell})
+		tmpl := rbuilder.NewTemplate(f, nil, rbuilder.WithStrictKeys())
+
+		_, err := tmpl.Render(d)
+		ce, ok := err.(*rbuilder.CellError)
+		if !ok {
+			t.Errorf("%s: expected *CellError, got %v", tt.cell, err)
+			continue
+		}
+
+		if ce.Kind != tt.kind || ce.Sheet != "Sheet1" || ce.Cell != tt.ref || ce.Row != 1 || ce.Col != 1 || ce.Text != tt.cell {
+			t.Errorf("%s: unexpected error %+v", tt.cell, ce)
+		}
+	}
+}
+
+func TestRenderDirectiveErrors(t *testing.T) {
+
+	tests := []struct {
+		cell string
+		kind rbuilder.ErrorKind
+		msg  string
+	}{
+		{"{{merge}}", rbuilder.ParseError, "wrong number of args for merge: want 2 got 0"},
+		{"{{range .D}}{{merge 1}}{{.}}{{end.}}", rbuilder.ParseError, "wrong number of args for merge: want 2 got 1"},
+		{"{{bold 1}}", rbuilder.ParseError, "wrong number of args for bold: want 0 got 1"},
+		{"{{printf \"%s\" color}}", rbuilder.ParseError, "wrong number of args for color: want 1 got 0"},
+		{"{{total}}", rbuilder.ParseError, "wrong number of args for total: want at least 1 got 0"},
+		{"{{merge -1 1}}x", rbuilder.ExecError, "<merge -1 1>"},
+	}
+
+	for _, tt := range tests {
+		tmpl := rbuilder.NewTemplate(newTemplateFile(t, []string{tt.cell}), nil)
+
+		_, err := tmpl.Render([]int{1})
+		ce, ok := err.(*rbuilder.CellError)
+		if !ok {
+			t.Errorf("%s: expected *CellError, got %v", tt.cell, err)
+			continue
+		}
+
+		if ce.Kind != tt.kind || !strings.Contains(ce.Error(), tt.msg) || strings.Contains(ce.Error(), "$.R") {
+			t.Errorf("%s: unexpected error %v", tt.cell, ce)
+		}
+	}
+
+	// piped value is the last argument of the directive
+	tmpl := rbuilder.NewTemplate(newTemplateFile(t, []string{"{{1 | merge 2}}x"}), nil)
+	if _, err := tmpl.Render(nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRenderReservedState(t *testing.T) {
+
+	for _, cell := range []string{"{{$.R}}", "{{.R.Capture 1}}", "{{if .D}}{{len $.R.Frame}}{{end}}", "{{range .D}}{{$.R}}{{.}}{{end.}}"} {
+		tmpl := rbuilder.NewTemplate(newTemplateFile(t, []string{cell}), nil)
+
+		_, err := tmpl.Compile()
+		ce, ok := err.(*rbuilder.CellError)
+		if !ok || ce.Kind != rbuilder.ParseError || !strings.Contains(ce.Error(), "reserved") {
+			t.Errorf("%s: expected parse error, got %v", cell, err)
+		}
+	}
+
+	// field R of data elements is not the render state
+	tmpl := rbuilder.NewTemplate(newTemplateFile(t, []string{"{{range .D}}{{.R}}{{end.}}"}), nil)
+	out, err := tmpl.Render([]struct{ R int }{{1}, {2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sheetValues(out.Sheets[0]); fmt.Sprint(got) != "[[1] [2]]" {
+		t.Errorf("expected elements, got %q", got)
+	}
+}
+
+func TestRenderMissingKey(t *testing.T) {
+
+	f := newTemplateFile(t, []string{"{{range .D}}{{.Tooth}}{{end.}}"})
+	d := []map[string]interface{}{{"Name": "x"}, {"Tooth": 12}}
+
+	tmpl := rbuilder.NewTemplate(f, nil)
+	out, err := tmpl.Render(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{{"<no value>"}, {"12"}}
+	if got := sheetValues(out.Sheets[0]); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	tmpl = rbuilder.NewTemplate(f, nil, rbuilder.WithStrictKeys())
+	_, err = tmpl.Render(d)
+	if ce, ok := err.(*rbuilder.CellError); !ok || ce.Kind != rbuilder.MissingKeyError || ce.Cell != "A1" {
+		t.Errorf("expected missing key error of A1, got %v", err)
+	}
+}
+
+type testLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *testLogger) log(level, msg string, args ...interface{}) {
+	l.mu.Lock()
+	l.msgs = append(l.msgs, level+" "+msg+" "+fmt.Sprint(args...))
+	l.mu.Unlock()
+}
+
+func (l *testLogger) Debug(msg string, args ...interface{}) { l.log("DEBUG", msg, args...) }
+func (l *testLogger) Info(msg string, args ...interface{})  { l.log("INFO", msg, args...) }
+func (l *testLogger) Warn(msg string, args ...interface{})  { l.log("WARN", msg, args...) }
+func (l *testLogger) Error(msg string, args ...interface{}) { l.log("ERROR", msg, args...) }
+
+func TestRenderLogger(t *testing.T) {
+
+	f := newTemplateFile(t,
+		[]string{"{{range .D}}{{.}}{{end.}}"},
+	)
+
+	l := &testLogger{}
+	tmpl := rbuilder.NewTemplate(f, nil, rbuilder.WithLogger(l))
+	if _, err := tmpl.Render([]int{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	has := func(prefix string) bool {
+		for _, msg := range l.msgs {
+			if strings.HasPrefix(msg, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !has("DEBUG expand range") {
+		t.Errorf("range expansion is not logged: %q", l.msgs)
+	}
+	if !has("INFO render done") {
+		t.Errorf("end of rendering is not logged: %q", l.msgs)
+	}
+	if len(l.msgs) != 2 {
+		t.Errorf("expected messages of the block and of the render, got %q", l.msgs)
+	}
+
+	// auto filter of deleted rows is lost
+	f.Sheets[0].AutoFilter = &xlsx.AutoFilter{TopLeftCell: "A1", BottomRightCell: "A1"}
+	f.Sheets[0].Rows[0].AddCell().SetFormula("1+1")
+	tmpl = rbuilder.NewTemplate(f, nil, rbuilder.WithLogger(l))
+	if _, err := tmpl.Render([]int{}); err != nil {
+		t.Fatal(err)
+	}
+	if !has("WARN auto filter is removed") {
+		t.Errorf("lost auto filter is not logged: %q", l.msgs)
+	}
+
+	if _, err := tmpl.Render("x"); err == nil || !has("ERROR render failed") {
+		t.Errorf("failed rendering is not logged: %q", l.msgs)
+	}
+}
+
+func TestRenderEmptyRangeShiftsReferences(t *testing.T) {
+
+	f := newTemplateFile(t,
+		[]string{"Summary", ""},
+		[]string{"Total", ""},
+	)
+	f.Sheets[0].Rows[1].Cells[1].SetFormula("Details!B5+'Details'!B1")
+
+	details, err := f.AddSheet("Details")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cells := range [][]string{
+		{"Header", "1"},
+		{"{{range .D}}{{.}}", "{{end.}}"},
+		{"", ""},
+		{"Merged", ""},
+		{"Sum", ""},
+	} {
+		row := details.AddRow()
+		for _, val := range cells {
+			row.AddCell().SetString(val)
+		}
+	}
+	// merge cut by the range and merge what starts in the range
+	details.Rows[0].Cells[0].VMerge = 2
+	details.Rows[1].Cells[1].VMerge = 2
+	details.Rows[4].Cells[1].SetFormula("SUM(B1:B4)+$B$4+SUM(2:3)")
+	details.AutoFilter = &xlsx.AutoFilter{TopLeftCell: "A1", BottomRightCell: "B5"}
+
+	tmpl := rbuilder.NewTemplate(f, nil)
+	out, err := tmpl.Render([]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := sheetValues(out.Sheets[0]); fmt.Sprint(got) != fmt.Sprint([][]string{{"Summary", ""}, {"Total", ""}}) {
+		t.Errorf("first sheet is changed: %q", got)
+	}
+
+	sheet := out.Sheets[1]
+	expected := [][]string{
+		{"Header", "1"},
+		{"", ""},
+		{"Merged", ""},
+		{"Sum", ""},
+	}
+	if got := sheetValues(sheet); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	if v := sheet.Rows[0].Cells[0].VMerge; v != 1 {
+		t.Errorf("expected VMerge 1, got %d", v)
+	}
+	if v := sheet.Rows[1].Cells[1].VMerge; v != 1 {
+		t.Errorf("expected VMerge 1, got %d", v)
+	}
+
+	if f := sheet.Rows[3].Cells[1].Formula(); f != "SUM(B1:B3)+$B$3+SUM(2:2)" {
+		t.Errorf("unexpected formula %s", f)
+	}
+	if f := out.Sheets[0].Rows[1].Cells[1].Formula(); f != "Details!B4+'Details'!B1" {
+		t.Errorf("unexpected formula %s", f)
+	}
+	if a := sheet.AutoFilter; a == nil || a.BottomRightCell != "B4" {
+		t.Errorf("auto filter is not shifted: %+v", a)
+	}
+}
+
+func TestRenderExpandedRangeShiftsFormulas(t *testing.T) {
+
+	f := newTemplateFile(t,
+		[]string{"Header", "", "", ""},
+		[]string{"{{range .D}}{{.}}", "{{.}}{{end.}}", "", ""},
+		[]string{"Total", "", "", ""},
+	)
+	sheet := f.Sheets[0]
+	sheet.Rows[1].Cells[2].SetFormula("B2*2")
+	sheet.Rows[1].Cells[3].SetFormula("B2/$B$3")
+	sheet.Rows[2].Cells[1].SetFormula("SUM(B2:B2)")
+	sheet.Rows[2].Cells[2].SetFormula("SUM(Sheet1!C2:C2)")
+
+	other, err := f.AddSheet("Other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.AddRow().AddCell().SetFormula("Sheet1!B3*2")
+
+	tmpl := rbuilder.NewTemplate(f, nil)
+	p, err := tmpl.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(out *xlsx.File) {
+		expected := map[string]string{
+			"C2": "B2*2", "C3": "B3*2", "C4": "B4*2",
+			"D2": "B2/$B$5", "D3": "B3/$B$5", "D4": "B4/$B$5",
+			"B5": "SUM(B2:B4)", "C5": "SUM(Sheet1!C2:C4)",
+		}
+		for ref, formula := range expected {
+			c, r, _ := xlsx.GetCoordsFromCellIDString(ref)
+			if got := out.Sheets[0].Cell(r, c).Formula(); got != formula {
+				t.Errorf("%s: expected %s, got %s", ref, formula, got)
+			}
+		}
+		if got := out.Sheets[1].Cell(0, 0).Formula(); got != "Sheet1!B5*2" {
+			t.Errorf("expected cross-sheet reference Sheet1!B5*2, got %s", got)
+		}
+	}
+
+	out, err := p.Render([]int{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(out)
+
+	ch := make(chan int, 3)
+	ch <- 1
+	ch <- 2
+	ch <- 3
+	close(ch)
+
+	buf := bytes.NewBuffer(nil)
+	if err := p.RenderStream(buf, ch); err != nil {
+		t.Fatal(err)
+	}
+	if out, err = xlsx.OpenBinary(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"C3": "B3*2", "C4": "B4*2", "B5": "SUM(B2:B4)", "C5": "SUM(Sheet1!C2:C4)"}
+	for ref, formula := range expected {
+		c, r, _ := xlsx.GetCoordsFromCellIDString(ref)
+		if got := out.Sheets[0].Cell(r, c).Formula(); got != formula {
+			t.Errorf("stream %s: expected %s, got %s", ref, formula, got)
+		}
+	}
+}
+
+func TestRenderColumnRangeShiftsFormulas(t *testing.T) {
+
+	f := newTemplateFile(t,
+		[]string{"{{range .D}}{{.}}{{endcol.}}", ""},
+		[]string{"", ""},
+	)
+	sheet := f.Sheets[0]
+	sheet.Rows[0].Cells[1].SetFormula("SUM(A1:A1)")
+	sheet.Rows[1].Cells[0].SetFormula("A1*2")
+	sheet.Rows[1].Cells[1].SetFormula("SUM(A:A)+$A$1")
+	sheet.AutoFilter = &xlsx.AutoFilter{TopLeftCell: "A1", BottomRightCell: "B2"}
+
+	other, err := f.AddSheet("Other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.AddRow().AddCell().SetFormula("Sheet1!B1+Sheet1!A2")
+
+	tmpl := rbuilder.NewTemplate(f, nil)
+
+	check := func(d []int, expected map[string]string, cross, filter string) {
+		out, err := tmpl.Render(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for ref, formula := range expected {
+			c, r, _ := xlsx.GetCoordsFromCellIDString(ref)
+			if got := out.Sheets[0].Cell(r, c).Formula(); got != formula {
+				t.Errorf("%d elements, %s: expected %s, got %s", len(d), ref, formula, got)
+			}
+		}
+		if got := out.Sheets[1].Cell(0, 0).Formula(); got != cross {
+			t.Errorf("%d elements: expected cross-sheet reference %s, got %s", len(d), cross, got)
+		}
+		af := out.Sheets[0].AutoFilter
+		if af == nil || af.TopLeftCell+":"+af.BottomRightCell != filter {
+			t.Errorf("%d elements: expected auto filter %s, got %+v", len(d), filter, af)
+		}
+	}
+
+	check([]int{1, 2, 3}, map[string]string{
+		"D1": "SUM(A1:C1)",
+		"A2": "A1*2", "B2": "B1*2", "C2": "C1*2",
+		"D2": "SUM(A:C)+$A$1",
+	}, "Sheet1!D1+Sheet1!A2", "A1:D2")
+
+	// empty range removes the column
+	check([]int{}, map[string]string{
+		"A1": "SUM(#REF!)",
+		"A2": "SUM(#REF!)+#REF!",
+	}, "Sheet1!A1+Sheet1!#REF!", "A1:A2")
+}
+
+func TestRenderRangeMerges(t *testing.T) {
+
+	f := newTemplateFile(t,
+		[]string{"Report", "", ""},
+		[]string{"{{range .D}}{{.Name}}", "Items", ""},
+		[]string{"", "{{range .Items}}{{.}}{{end.}}", ""},
+		[]string{"", "end{{end.}}", ""},
+	)
+	sheet := f.Sheets[0]
+	// заголовок на всю высоту отчета, метка группы на всю высоту группы
+	sheet.Rows[0].Cells[2].VMerge = 3
+	sheet.Rows[1].Cells[0].VMerge = 2
+	sheet.Rows[2].Cells[1].HMerge = 1
+
+	d := []map[string]interface{}{
+		{"Name": "A", "Items": []int{1, 2, 3}},
+		{"Name": "B", "Items": []int{}},
+	}
+
+	tmpl := rbuilder.NewTemplate(f, nil)
+	out, err := tmpl.Render(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{
+		{"Report", "", ""},
+		{"A", "Items", ""},
+		{"", "1", ""},
+		{"", "2", ""},
+		{"", "3", ""},
+		{"", "end", ""},
+		{"B", "Items", ""},
+		{"", "end", ""},
+	}
+	got := sheetValues(out.Sheets[0])
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("expected %q, got %q", expected, got)
+	}
+
+	rows := out.Sheets[0].Rows
+	if v := rows[0].Cells[2].VMerge; v != 7 {
+		t.Errorf("header merge: expected VMerge 7, got %d", v)
+	}
+	if v := rows[1].Cells[0].VMerge; v != 4 {
+		t.Errorf("group A: expected VMerge 4, got %d", v)
+	}
+	if v := rows[6].Cells[0].VMerge; v != 1 {
+		t.Errorf("group B: expected VMerge 1, got %d", v)
+	}
+	for r := 2; r <= 4; r++ {
+		if h := rows[r].Cells[1].HMerge; h != 1 {
+			t.Errorf("row %d: expected HMerge 1, got %d", r, h)
+		}
+	}
+
+	if err := out.Write(ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRenderMergeDirectives(t *testing.T) {
+
+	f := newTemplateFile(t,
+		[]string{"{{.S}}{{merge 3 1}}", "", ""},
+		[]string{"{{range .D}}{{.Group}}{{mergeSame}}", "{{.Item}}{{end.}}", ""},
+	)
+
+	type item struct{ Group, Item string }
+	d := []item{{"A", "1"}, {"A", "2"}, {"A", "3"}, {"B", "4"}, {"B", "5"}, {"C", "6"}}
+
+	tmpl := rbuilder.NewTemplate(f, "Items")
+	out, err := tmpl.Render(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{
+		{"Items", "", ""},
+		{"A", "1", ""},
+		{"", "2", ""},
+		{"", "3", ""},
+		{"B", "4", ""},
+		{"", "5", ""},
+		{"C", "6", ""},
+	}
+	if got := sheetValues(out.Sheets[0]); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	rows := out.Sheets[0].Rows
+	if c := rows[0].Cells[0]; c.HMerge != 2 || c.VMerge != 0 {
+		t.Errorf("fixed merge: got %dx%d", c.HMerge, c.VMerge)
+	}
+	for r, v := range []int{0, 2, 0, 0, 1, 0, 0} {
+		if got := rows[r].Cells[0].VMerge; got != v {
+			t.Errorf("row %d: expected VMerge %d, got %d", r, v, got)
+		}
+	}
+
+	f = newTemplateFile(t, []string{"{{merge 0 1}}"})
+	tmpl = rbuilder.NewTemplate(f, nil)
+	if _, err := tmpl.Render(nil); err == nil {
+		t.Errorf("expected error for invalid merge size")
+	}
+}
+
+func TestRenderDirectivesFromData(t *testing.T) {
+
+	f := newTemplateFile(t,
+		[]string{"{{.D}}", "Dr. {{.D}}", "{{print bold}}{{.D}}", "{{bold}}"},
+	)
+
+	// текст директивы в данных остается текстом
+	d := "\x00formula:HYPERLINK(\"http://evil\")\x00\x00merge:3:2\x00"
+
+	tmpl := rbuilder.NewTemplate(f, nil, rbuilder.WithFuncs(template.FuncMap{"bold": func() string { return "B" }}))
+	out, err := tmpl.Render(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for c, exp := range []string{d, "Dr. " + d, "B" + d, "B"} {
+		cell := out.Sheets[0].Rows[0].Cells[c]
+		if cell.Value != exp || cell.Formula() != "" || cell.HMerge != 0 || cell.VMerge != 0 {
+			t.Errorf("cell %d: expected %q, got %q (formula %q, merge %dx%d)", c, exp, cell.Value, cell.Formula(), cell.HMerge, cell.VMerge)
+		}
+	}
+
+	// директива в аргументе другой функции получает состояние
+	f = newTemplateFile(t, []string{`{{print (formula "A2") (bold)}}`, `{{printf "%s" mergeSame}}x`})
+	tmpl = rbuilder.NewTemplate(f, nil)
+	if out, err = tmpl.Render(nil); err != nil {
+		t.Fatal(err)
+	}
+	if c := out.Sheets[0].Rows[0].Cells[0]; c.Formula() != "A2" || !c.GetStyle().Font.Bold {
+		t.Errorf("expected bold formula A2, got %q", c.Formula())
+	}
+}
+
+func TestRenderTypedValues(t *testing.T) {
+
+	f := newTemplateFile(t,
+		[]string{"{{.S}}", "", "", "", "", ""},
+		[]string{"{{range .D}}{{.Date}}", "{{.Date}}", "{{.Paid}}", "{{.Amount}}", `{{formula "D2*2"}}`, `{{.Date | fdate "02.01.2006"}}{{end.}}`},
+		[]string{"Total", "", "", "", `{{formula "SUM(E2:E2)"}}`, ""},
+	)
+	f.Sheets[0].Rows[1].Cells[0].NumFmt = "yyyy-mm-dd"
+
+	type item struct {
+		Date   time.Time
+		Paid   bool
+		Amount float64
+	}
+	msk := time.FixedZone("MSK", 3*60*60)
+	d := []item{
+		{time.Date(2020, 1, 2, 15, 4, 5, 0, msk), true, 10.5},
+		{time.Date(2020, 1, 3, 0, 0, 0, 0, msk), false, 7},
+	}
+
+	tmpl := rbuilder.NewTemplate(f, "Payments")
+	p, err := tmpl.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(name string, sheet *xlsx.Sheet) {
+		for r, it := range d {
+			row := sheet.Rows[r+1]
+			wall := time.Date(it.Date.Year(), it.Date.Month(), it.Date.Day(), it.Date.Hour(), it.Date.Minute(), it.Date.Second(), 0, time.UTC)
+			for c := 0; c < 2; c++ {
+				got, err := row.Cells[c].GetTime(false)
+				if err != nil || got.Sub(wall) > time.Millisecond || wall.Sub(got) > time.Millisecond {
+					t.Errorf("%s: row %d col %d: expected date %v, got %v (%v)", name, r+1, c, wall, got, err)
+				}
+			}
+			if got := row.Cells[2]; got.Type() != xlsx.CellTypeBool || got.Bool() != it.Paid {
+				t.Errorf("%s: row %d: expected bool %v, got %q", name, r+1, it.Paid, got.Value)
+			}
+			if got := row.Cells[3]; got.Type() != xlsx.CellTypeNumeric || got.Value != fmt.Sprint(it.Amount) {
+				t.Errorf("%s: row %d: expected number %v, got %q", name, r+1, it.Amount, got.Value)
+			}
+			if got, exp := row.Cells[4].Formula(), fmt.Sprintf("D%d*2", r+2); got != exp {
+				t.Errorf("%s: row %d: expected formula %q, got %q", name, r+1, exp, got)
+			}
+			if got, exp := row.Cells[5].Value, it.Date.Format("02.01.2006"); got != exp {
+				t.Errorf("%s: row %d: expected text %q, got %q", name, r+1, exp, got)
+			}
+		}
+		if got := sheet.Rows[3].Cells[4].Formula(); got != "SUM(E2:E3)" {
+			t.Errorf("%s: expected total SUM(E2:E3), got %q", name, got)
+		}
+	}
+
+	out, err := p.Render(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sheet := out.Sheets[0]
+	check("Render", sheet)
+
+	if got := sheet.Rows[1].Cells[0].NumFmt; got != "yyyy-mm-dd" {
+		t.Errorf("expected date format of the template, got %q", got)
+	}
+	if got := sheet.Rows[1].Cells[1].NumFmt; got != "dd.mm.yyyy hh:mm:ss" {
+		t.Errorf("expected default date format, got %q", got)
+	}
+
+	it := make(sliceIterator, 0, len(d))
+	for _, v := range d {
+		it = append(it, v)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := p.RenderStream(buf, &it); err != nil {
+		t.Fatal(err)
+	}
+	if out, err = xlsx.OpenBinary(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	check("RenderStream", out.Sheets[0])
+}
+
+func TestRenderLocale(t *testing.T) {
+
+	f := newTemplateFile(t,
+		[]string{"{{.D.Sum}}", "{{fnum 2 .D.Amount}}", "{{fmoney 2 .D.Amount}}", "{{fdateloc .D.Date}}", "{{.D.Code}}"},
+	)
+
+	d := map[string]interface{}{
+		"Sum":    "2\u00a0739,00",
+		"Amount": -1234567.891,
+		"Date":   time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC),
+		"Code":   "1 23",
+	}
+
+	tmpl := rbuilder.NewTemplate(f, nil, rbuilder.WithLocale(rbuilder.LocaleRU))
+	out, err := tmpl.Render(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cells := out.Sheets[0].Rows[0].Cells
+	for i, exp := range []struct {
+		val     string
+		numeric bool
+	}{
+		{"2739", true},
+		{"-1234567.89", true},
+		{"-1\u00a0234\u00a0567,89\u00a0₽", false},
+		{"02.01.2020", false},
+		{"1 23", false},
+	} {
+		if cells[i].Value != exp.val || (cells[i].Type() == xlsx.CellTypeNumeric) != exp.numeric {
+			t.Errorf("cell %d: expected %q (numeric %v), got %q (type %v)", i, exp.val, exp.numeric, cells[i].Value, cells[i].Type())
+		}
+	}
+
+	// без локали запятая не является разделителем дробной части
+	tmpl = rbuilder.NewTemplate(newTemplateFile(t, []string{"{{.D.Sum}}"}), nil)
+	if out, err = tmpl.Render(d); err != nil {
+		t.Fatal(err)
+	}
+	if c := out.Sheets[0].Rows[0].Cells[0]; c.Type() != xlsx.CellTypeString {
+		t.Errorf("expected text without locale, got %q (type %v)", c.Value, c.Type())
+	}
+
+	// точка разделяет группы разрядов, а не дробную часть
+	tmpl = rbuilder.NewTemplate(newTemplateFile(t, []string{"{{.D}}"}), nil, rbuilder.WithLocale(rbuilder.Locale{Decimal: ",", Group: "."}))
+	if out, err = tmpl.Render("1.234"); err != nil {
+		t.Fatal(err)
+	}
+	if c := out.Sheets[0].Rows[0].Cells[0]; c.Value != "1234" || c.Type() != xlsx.CellTypeNumeric {
+		t.Errorf("expected 1234, got %q (type %v)", c.Value, c.Type())
+	}
+
+	if v, ok := rbuilder.LocaleEN.ParseNumber("1,234.5"); !ok || v != 1234.5 {
+		t.Errorf("expected 1234.5, got %v %v", v, ok)
+	}
+	if got := rbuilder.LocaleEN.FormatMoney(-5, 2); got != "-$5.00" {
+		t.Errorf("expected -$5.00, got %q", got)
+	}
+}
+
+func TestRenderFuncs(t *testing.T) {
+
+	f := newTemplateFile(t,
+		[]string{"{{toRubles .D.Price}}", "{{upper .D.Name}}", "{{toMeters .D.Length}}"},
+	)
+
+	tmpl := rbuilder.NewTemplate(f, nil, rbuilder.WithFuncs(template.FuncMap{
+		"toRubles": func(kopecks int) string { return fmt.Sprintf("%d руб. %02d коп.", kopecks/100, kopecks%100) },
+		"upper":    strings.ToUpper,
+	}))
+
+	out, err := tmpl.Render(map[string]interface{}{"Price": 273905, "Name": "услуга", "Length": 1500})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{{"2739 руб. 05 коп.", "УСЛУГА", "1.5"}}
+	if got := sheetValues(out.Sheets[0]); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	// функции другого шаблона не меняются
+	tmpl = rbuilder.NewTemplate(newTemplateFile(t, []string{"{{toRubles .D}}"}), nil)
+	if out, err = tmpl.Render(273905); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.Sheets[0].Rows[0].Cells[0].Value; got != "2739.05" {
+		t.Errorf("expected built-in toRubles, got %q", got)
+	}
+
+	tmpl = rbuilder.NewTemplate(newTemplateFile(t, []string{"{{bad}}"}), nil, rbuilder.WithFuncs(template.FuncMap{"bad": 1}))
+	if _, err := tmpl.Compile(); err == nil {
+		t.Errorf("expected error for invalid function")
+	}
+}
+
+func TestRenderConvertFuncs(t *testing.T) {
+
+	f := newTemplateFile(t,
+		[]string{"{{toTonnes .D.Weight}}", `{{conv .D.Weight 1000 0 "halfeven"}}`, `{{conv .D.Weight 1000 0 "up"}}`, `{{fcur "USD" 2 .D.Sum}}`, `{{symbol "EUR"}}`},
+		[]string{`{{sumInWords "ru" "RUB" .D.Sum}}`, `{{sumInWords "en" "USD" .D.Sum}}`, `{{inWords "ru" 1021}}`, `{{sumInWords "ru" "RUB" 1.01}}`},
+	)
+
+	tmpl := rbuilder.NewTemplate(f, nil, rbuilder.WithLocale(rbuilder.LocaleRU))
+	out, err := tmpl.Render(map[string]interface{}{"Weight": 2500, "Sum": 2739.05})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{
+		{"2.5", "2", "3", "2\u00a0739,05\u00a0$", "€"},
+		{
+			"Две тысячи семьсот тридцать девять рублей 05 копеек",
+			"Two thousand seven hundred thirty-nine dollars 05 cents",
+			"Одна тысяча двадцать один",
+			"Один рубль 01 копейка",
+		},
+	}
+	if got := sheetValues(out.Sheets[0]); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	if c := out.Sheets[0].Rows[0].Cells[0]; c.Type() != xlsx.CellTypeNumeric {
+		t.Errorf("expected numeric cell, got %v", c.Type())
+	}
+
+	tmpl = rbuilder.NewTemplate(newTemplateFile(t, []string{`{{conv 1 1 0 "sideways"}}`}), nil)
+	if _, err := tmpl.Render(nil); err == nil {
+		t.Errorf("expected error for unknown round mode")
+	}
+}
+
+func TestRound(t *testing.T) {
+
+	cases := []struct {
+		v        float64
+		decimals int
+		mode     rbuilder.RoundMode
+		exp      float64
+	}{
+		{1.005, 2, rbuilder.RoundHalfUp, 1.01},
+		{-1.005, 2, rbuilder.RoundHalfUp, -1.01},
+		{2.5, 0, rbuilder.RoundHalfEven, 2},
+		{3.5, 0, rbuilder.RoundHalfEven, 4},
+		{2.345, 2, rbuilder.RoundHalfEven, 2.34},
+		{2.99, 1, rbuilder.RoundDown, 2.9},
+		{2.01, 1, rbuilder.RoundUp, 2.1},
+		{-2.01, 1, rbuilder.RoundFloor, -2.1},
+		{-2.09, 1, rbuilder.RoundCeil, -2},
+		{1250, -2, rbuilder.RoundHalfEven, 1200},
+		{1e20 + 0.5, 0, rbuilder.RoundHalfUp, 1e20},
+		{9.223372036854776e18, 2, rbuilder.RoundHalfUp, 9.223372036854776e18},
+	}
+	for _, c := range cases {
+		if got := rbuilder.Round(c.v, c.decimals, c.mode); got != c.exp {
+			t.Errorf("Round(%v, %d, %v): expected %v, got %v", c.v, c.decimals, c.mode, c.exp, got)
+		}
+	}
+
+	if got := rbuilder.AwayFromZero(1e19, 2); got != 1e19 {
+		t.Errorf("AwayFromZero overflows: got %v", got)
+	}
+
+	f := newTemplateFile(t,
+		[]string{"{{round .D 1}}", `{{round .D 1 "ceil"}}`, "{{toRubles 12345}}", "{{add 0.1 0.2}}", "{{mul 1.1 3}}", "{{div 10 4}}", "{{fnum 1 .D}}"},
+	)
+	tmpl := rbuilder.NewTemplate(f, nil, rbuilder.WithRoundMode(rbuilder.RoundHalfEven))
+	out, err := tmpl.Render(0.25)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{{"0.2", "0.3", "123.45", "0.3", "3.3", "2.5", "0.2"}}
+	if got := sheetValues(out.Sheets[0]); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	tmpl = rbuilder.NewTemplate(newTemplateFile(t, []string{"{{div 1 0}}"}), nil)
+	if _, err := tmpl.Render(nil); err == nil {
+		t.Errorf("expected error for division by zero")
+	}
+}
+
+type service struct {
+	Name     string
+	Category string
+	Price    float64
+	Discount int
+}
+
+func (s service) Net() float64 { return s.Price - float64(s.Discount) }
+
+func TestRenderAggregates(t *testing.T) {
+
+	f := newTemplateFile(t,
+		[]string{`{{sum .D.Services "Price"}}`, `{{count .D.Services}}`, `{{count .D.Services "Discount"}}`, `{{avg .D.Services "Price"}}`, `{{min .D.Services "Net"}}`, `{{max .D.Services "Price"}}`, `{{sum .D.Counts}}`},
+		[]string{`{{range groupBy .D.Services "Category"}}{{.Key}}`, `{{count .Items}}`, `{{sum .Items "Price"}}{{end.}}`},
+	)
+
+	d := map[string]interface{}{
+		"Services": []service{
+			{"Осмотр", "Терапия", 0.1, 0},
+			{"Пломба", "Терапия", 0.2, 0},
+			{"Снимок", "Диагностика", 1500, 100},
+		},
+		"Counts": map[string]int{"a": 1, "b": 2},
+	}
+
+	tmpl := rbuilder.NewTemplate(f, nil)
+	out, err := tmpl.Render(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{
+		{"1500.3", "3", "1", "500.1", "0.1", "1500", "3"},
+		{"Терапия", "2", "0.3"},
+		{"Диагностика", "1", "1500"},
+	}
+	if got := sheetValues(out.Sheets[0]); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	if c := out.Sheets[0].Rows[0].Cells[0]; c.Type() != xlsx.CellTypeNumeric {
+		t.Errorf("expected numeric sum, got %v", c.Type())
+	}
+
+	tmpl = rbuilder.NewTemplate(newTemplateFile(t, []string{`{{sum .D "Missing"}}`}), nil)
+	if _, err := tmpl.Render([]service{{}}); err == nil {
+		t.Errorf("expected error for missing field")
+	}
+}
+
+func TestRenderTotals(t *testing.T) {
+
+	f := newTemplateFile(t,
+		[]string{"Group", "Price"},
+		[]string{"{{range .D}}{{.Name}}", ""},
+		[]string{"{{range .Items}}{{.Name}}", "{{.Price}}{{end.}}"},
+		[]string{"Subtotal", `{{total "SUBTOTAL"}}{{end.}}`},
+		[]string{"Total", `{{total "SUBTOTAL"}}`},
+		[]string{"Sum", `{{total "SUM" "B"}}`},
+	)
+
+	type item struct {
+		Name  string
+		Price float64
+	}
+	type group struct {
+		Name  string
+		Items []item
+	}
+	d := []group{
+		{"A", []item{{"a1", 10}, {"a2", 20}}},
+		{"B", nil},
+		{"C", []item{{"c1", 5}}},
+	}
+
+	tmpl := rbuilder.NewTemplate(f, nil)
+	p, err := tmpl.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// формулы колонки B, значения для строк без формул
+	expected := []string{"Price", "", "10", "20", "SUBTOTAL(9,B3:B4)", "", "0", "", "5", "SUBTOTAL(9,B9:B9)", "SUBTOTAL(9,B2:B10)", "SUM(B2:B10)"}
+	check := func(name string, sheet *xlsx.Sheet) {
+		got := make([]string, 0, len(sheet.Rows))
+		for _, row := range sheet.Rows {
+			c := row.Cells[1]
+			if c.Formula() != "" {
+				got = append(got, c.Formula())
+			} else {
+				got = append(got, c.Value)
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Errorf("%s: expected %q, got %q", name, expected, got)
+		}
+	}
+
+	out, err := p.Render(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("Render", out.Sheets[0])
+
+	it := make(sliceIterator, 0, len(d))
+	for _, g := range d {
+		it = append(it, g)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := p.RenderStream(buf, &it); err != nil {
+		t.Fatal(err)
+	}
+	if out, err = xlsx.OpenBinary(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	check("RenderStream", out.Sheets[0])
+
+	tmpl = rbuilder.NewTemplate(newTemplateFile(t, []string{`{{total "SUM"}}`}), nil)
+	if _, err := tmpl.Render(nil); err == nil {
+		t.Errorf("expected error for total without range")
+	}
+}
+
+func TestRenderGroups(t *testing.T) {
+
+	f := newTemplateFile(t,
+		[]string{`{{range groupBy .D "Route"}}Маршрут {{.Key}}`, ""},
+		[]string{`{{range groupBy .Items "Date" "02.01.2006"}}{{.Key}}`, ""},
+		[]string{"{{range .Items}}{{.ID}}", "{{toTonnes .Weight}}{{end.}}"},
+		[]string{"Итого за день", `{{toTonnes (.Sum "Weight")}}{{end.}}`},
+		[]string{"Итого {{.Key}}, рейсов {{.Count}}", `{{toTonnes (.Sum "Weight")}}{{end.}}`},
+	)
+
+	type shipment struct {
+		ID     int
+		Route  string
+		Date   time.Time
+		Weight int
+	}
+	day := func(d, h int) time.Time { return time.Date(2020, 1, d, h, 0, 0, 0, time.UTC) }
+	d := []shipment{
+		{1, "M-SPb", day(1, 10), 1500},
+		{2, "M-SPb", day(1, 15), 2500},
+		{3, "M-Kaz", day(1, 9), 1000},
+		{4, "M-SPb", day(2, 8), 500},
+	}
+
+	tmpl := rbuilder.NewTemplate(f, nil)
+	out, err := tmpl.Render(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{
+		{"Маршрут M-SPb", ""},
+		{"01.01.2020", ""},
+		{"1", "1.5"},
+		{"2", "2.5"},
+		{"Итого за день", "4"},
+		{"02.01.2020", ""},
+		{"4", "0.5"},
+		{"Итого за день", "0.5"},
+		{"Итого M-SPb, рейсов 3", "4.5"},
+		{"Маршрут M-Kaz", ""},
+		{"01.01.2020", ""},
+		{"3", "1"},
+		{"Итого за день", "1"},
+		{"Итого M-Kaz, рейсов 1", "1"},
+	}
+	if got := sheetValues(out.Sheets[0]); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	// ключ группы вычисляется функцией элемента
+	f = newTemplateFile(t,
+		[]string{`{{range groupBy .D .S.Heavy}}{{.Key}}`, `{{count .Items}}{{end.}}`},
+	)
+	heavy := func(s shipment) string {
+		if s.Weight >= 1500 {
+			return "heavy"
+		}
+		return "light"
+	}
+	tmpl = rbuilder.NewTemplate(f, map[string]interface{}{"Heavy": heavy})
+	if out, err = tmpl.Render(d); err != nil {
+		t.Fatal(err)
+	}
+
+	expected = [][]string{{"heavy", "2"}, {"light", "2"}}
+	if got := sheetValues(out.Sheets[0]); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	tmpl = rbuilder.NewTemplate(f, map[string]interface{}{"Heavy": func(s string) bool { return false }})
+	if _, err := tmpl.Render(d); err == nil {
+		t.Errorf("expected error for key function of other type")
+	}
+}
+
+func TestRenderConditionalRows(t *testing.T) {
+
+	f := newTemplateFile(t,
+		[]string{"Услуги", "{{.D.Sum}}"},
+		[]string{"{{if gt .D.Discount 0.0}}Скидка", "{{.D.Discount}}{{end.}}"},
+		[]string{"{{if .D.Notes}}Примечания", ""},
+		[]string{"{{range .D.Notes}}{{.}}{{end.}}", "{{end.}}"},
+		[]string{"Итого", ""},
+	)
+	f.Sheets[0].Rows[4].Cells[1].SetFormula("B1-B2")
+
+	type data struct {
+		Sum      float64
+		Discount float64
+		Notes    []string
+	}
+
+	tmpl := rbuilder.NewTemplate(f, nil)
+	p, err := tmpl.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := p.Render(data{Sum: 100, Discount: 0, Notes: []string{"a", "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{
+		{"Услуги", "100"},
+		{"Примечания", ""},
+		{"a", ""},
+		{"b", ""},
+		{"Итого", ""},
+	}
+	if got := sheetValues(out.Sheets[0]); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	if got := out.Sheets[0].Rows[4].Cells[1].Formula(); got != "B1-#REF!" {
+		t.Errorf("expected reference to removed row to be #REF!, got %q", got)
+	}
+
+	out, err = p.Render(data{Sum: 100, Discount: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = [][]string{
+		{"Услуги", "100"},
+		{"Скидка", "5"},
+		{"Итого", ""},
+	}
+	if got := sheetValues(out.Sheets[0]); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	if got := out.Sheets[0].Rows[2].Cells[1].Formula(); got != "B1-B2" {
+		t.Errorf("expected formula B1-B2, got %q", got)
+	}
+
+	tmpl = rbuilder.NewTemplate(newTemplateFile(t, []string{"{{if .D}}a{{else}}b{{end.}}"}), nil)
+	if _, err := tmpl.Compile(); err == nil {
+		t.Errorf("expected error for {{else}} of the block")
+	}
+}
+
+func TestRenderStreamDates(t *testing.T) {
+
+	f := newTemplateFile(t, []string{"{{range .D}}{{.}}", "{{.}}{{end.}}"})
+	f.Sheets[0].Rows[0].Cells[0].GetStyle().Font.Bold = true
+
+	tmpl := rbuilder.NewTemplate(f, nil)
+	p, err := tmpl.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dates := []interface{}{
+		time.Date(2016, 10, 19, 0, 0, 0, 0, time.UTC),
+		time.Date(2016, 10, 19, 12, 30, 0, 0, time.UTC),
+	}
+
+	res, err := p.Render(dates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := res.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	rendered, err := xlsx.OpenBinary(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf.Reset()
+	it := sliceIterator(dates)
+	if err := p.RenderStream(&buf, &it); err != nil {
+		t.Fatal(err)
+	}
+	streamed, err := xlsx.OpenBinary(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for r, format := range []string{"dd.mm.yyyy", "dd.mm.yyyy hh:mm:ss"} {
+		for c := 0; c < 2; c++ {
+			want := rendered.Sheets[0].Cell(r, c)
+			got := streamed.Sheets[0].Cell(r, c)
+			if want.GetNumberFormat() != format || got.GetNumberFormat() != format {
+				t.Errorf("%s: expected format %s, got %s by Render and %s by RenderStream",
+					xlsx.GetCellIDStringFromCoords(c, r), format, want.GetNumberFormat(), got.GetNumberFormat())
+			}
+			if got.Value != want.Value {
+				t.Errorf("%s: expected %s, got %s", xlsx.GetCellIDStringFromCoords(c, r), want.Value, got.Value)
+			}
+			if bold := c == 0; got.GetStyle().Font.Bold != bold {
+				t.Errorf("%s: expected bold %v", xlsx.GetCellIDStringFromCoords(c, r), bold)
+			}
+		}
+	}
+}
+
+func TestRenderCellStyles(t *testing.T) {
+
+	f := newTemplateFile(t,
+		[]string{"{{range .D}}{{.Name}}", `{{if lt .Balance 0.0}}{{color "red"}}{{bold}}{{end}}{{.Balance}}`,
+			`{{if .Overdue}}{{fill "#FFFF00"}}{{border "thin" "red"}}{{end}}{{.Overdue}}{{end.}}`},
+	)
+	base := xlsx.NewStyle()
+	base.Font.Name = "Arial"
+	base.Font.Size = 10
+	base.ApplyFont = true
+	for _, c := range f.Sheets[0].Rows[0].Cells {
+		c.SetStyle(base)
+	}
+
+	type account struct {
+		Name    string
+		Balance float64
+		Overdue bool
+	}
+
+	tmpl := rbuilder.NewTemplate(f, nil)
+	p, err := tmpl.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := p.Render([]account{{"a", 10, false}, {"b", -5, true}, {"c", -1, false}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := res.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out, err := xlsx.OpenBinary(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := out.Sheets[0].Rows
+
+	for i, neg := range []bool{false, true, true} {
+		st := rows[i].Cells[1].GetStyle()
+		if neg && (st.Font.Color != "FFFF0000" || !st.Font.Bold) {
+			t.Errorf("row %d: expected red bold font, got %+v", i, st.Font)
+		}
+		if !neg && (st.Font.Color != "" || st.Font.Bold) {
+			t.Errorf("row %d: expected template font, got %+v", i, st.Font)
+		}
+		if st.Font.Name != "Arial" || st.Font.Size != 10 {
+			t.Errorf("row %d: expected font of the template to be kept, got %+v", i, st.Font)
+		}
+	}
+
+	if st := rows[1].Cells[2].GetStyle(); st.Fill.PatternType != "solid" || st.Fill.FgColor != "FFFFFF00" ||
+		st.Border.Left != "thin" || st.Border.BottomColor != "FFFF0000" {
+		t.Errorf("expected yellow fill and red border, got %+v %+v", st.Fill, st.Border)
+	}
+	if st := rows[0].Cells[2].GetStyle(); st.Fill.PatternType == "solid" || st.Border.Left == "thin" {
+		t.Errorf("expected template fill and border, got %+v %+v", st.Fill, st.Border)
+	}
+	if st := f.Sheets[0].Rows[0].Cells[1].GetStyle(); st.Font.Color != "" || st.Font.Bold {
+		t.Errorf("expected style of the template to be unchanged, got %+v", st.Font)
+	}
+
+	// директивы не мешают записи значения с сохранением типа
+	tmpl = rbuilder.NewTemplate(newTemplateFile(t, []string{"{{bold}}{{.D.Date}}", "{{.D.OK}}{{fill \"red\"}}"}), nil)
+	d := map[string]interface{}{"Date": time.Date(2016, 10, 19, 0, 0, 0, 0, time.UTC), "OK": true}
+	if res, err = tmpl.Render(d); err != nil {
+		t.Fatal(err)
+	}
+	if c := res.Sheets[0].Rows[0].Cells[0]; c.Value != "42662" || c.GetNumberFormat() != "dd.mm.yyyy" || !c.GetStyle().Font.Bold {
+		t.Errorf("expected bold date, got %q (format %q)", c.Value, c.GetNumberFormat())
+	}
+	if c := res.Sheets[0].Rows[0].Cells[1]; c.Type() != xlsx.CellTypeBool || c.GetStyle().Fill.FgColor != "FFFF0000" {
+		t.Errorf("expected filled boolean, got %q (type %v)", c.Value, c.Type())
+	}
+
+	tmpl = rbuilder.NewTemplate(newTemplateFile(t, []string{`{{color "redish"}}`}), nil)
+	if p, err = tmpl.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Render(nil); err == nil {
+		t.Errorf("expected error for invalid color")
+	}
+}
+
+func TestRenderAutoFitRows(t *testing.T) {
+
+	f := newTemplateFile(t,
+		[]string{"Услуги", ""},
+		[]string{"{{range .D}}{{.Code}}", "{{.Name}}{{end.}}"},
+	)
+	sheet := f.Sheets[0]
+	sheet.Rows[1].SetHeight(15)
+	sheet.Cols[1].Width = 20
+
+	wrap := xlsx.NewStyle()
+	wrap.Font.Size = 10
+	wrap.Alignment.WrapText = true
+	wrap.ApplyAlignment = true
+	sheet.Rows[1].Cells[1].SetStyle(wrap)
+
+	long := "Лечение периодонтита однокорневого зуба, пломбирование каналов с применением " +
+		"термофила \"Гуттакор\" (аппарат \"Термапреп\"); вертикальной конденсации (аппарат \"Каламус\")"
+	type service struct{ Code, Name string }
+	data := []service{{"1.1", "Осмотр пациента"}, {"6.17.1", long}}
+
+	tmpl := rbuilder.NewTemplate(f, nil, rbuilder.WithAutoFitRows())
+	p, err := tmpl.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := p.Render(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := out.Sheets[0].Rows
+	if rows[1].Height != 15 {
+		t.Errorf("expected short text to keep the template height, got %g", rows[1].Height)
+	}
+	// 160 символов по 22 в строке занимают 8 строк
+	if rows[2].Height < 8*10*1.3 || rows[2].Height > 10*10*1.4 {
+		t.Errorf("expected height of 8 lines, got %g", rows[2].Height)
+	}
+	if rows[0].Height != 0 {
+		t.Errorf("expected static row to keep the height, got %g", rows[0].Height)
+	}
+
+	var buf bytes.Buffer
+	it := sliceIterator{data[0], data[1]}
+	if err := p.RenderStream(&buf, &it); err != nil {
+		t.Fatal(err)
+	}
+	res, err := xlsx.OpenBinary(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.Sheets[0].Rows[2].Height, rows[2].Height; got != want {
+		t.Errorf("expected streamed row height %g, got %g", want, got)
+	}
+	if got := res.Sheets[0].Rows[1].Height; got != 15 {
+		t.Errorf("expected streamed short row height 15, got %g", got)
+	}
+
+	tmpl = rbuilder.NewTemplate(f, nil)
+	if out, err = tmpl.Render(data); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.Sheets[0].Rows[2].Height; got != 15 {
+		t.Errorf("expected the template height without auto-fit, got %g", got)
+	}
+}
@@ -0,0 +1,94 @@
+package rbuilder
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tealeg/xlsx"
+)
+
+const totalDirective = "total"
+
+// totalFunc is {{total "SUM"}} in the cell under {{range}}{{end.}}: the cell
+// gets formula what aggregates the column of the cell over all rows rendered
+// by the range, like =SUM(F5:F27), so the total stays live when the report
+// is edited. The closest range of the same level what ends above the cell
+// is used, so the cell in the group band sums rows of the nested range of
+// the group. "SUBTOTAL" writes SUBTOTAL(9,...) what skips other subtotals,
+// then group totals and the grand total do not sum the same rows twice.
+// Optional column like "F" aggregates other column.
+func totalFunc(st *renderState, fn string, col ...string) (string, error) {
+
+	fn = strings.ToUpper(fn)
+	if fn == "" || strings.Trim(fn, "ABCDEFGHIJKLMNOPQRSTUVWXYZ.") != "" {
+		return "", fmt.Errorf("total: invalid function %q", fn)
+	}
+
+	c := ""
+	switch len(col) {
+	case 0:
+	case 1:
+		c = strings.ToUpper(col[0])
+		if c == "" || len(c) > 3 || strings.Trim(c, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+			return "", fmt.Errorf("total: invalid column %q", col[0])
+		}
+	default:
+		return "", fmt.Errorf("total: only one column is expected, got %d", len(col))
+	}
+
+	st.directive(totalDirective, fn, c)
+	return "", nil
+}
+
+// setTotal writes formula of {{total}} into the cell what is rendered now.
+func (rr *renderer) setTotal(cell *xlsx.Cell, args []string) error {
+
+	tc := rr.tc
+	if tc == nil || tc.above == nil {
+		return errors.New("total: no {{range}} above the cell")
+	}
+
+	if len(args) != 2 {
+		return errors.New("invalid total directive")
+	}
+	fn, col := args[0], args[1]
+	if col == "" {
+		col = xlsx.ColIndexToLetters(tc.loc.col)
+	}
+
+	// область строк блока в шаблоне, ссылки формулы сдвигаются вместе с
+	// ячейкой и растут при добавлении строк блока
+	b := tc.above
+	area := fmt.Sprintf("%s%d:%s%d", col, b.top+1, col, b.top+b.height)
+
+	if fn == "SUBTOTAL" {
+		rr.setFormula(cell, "SUBTOTAL(9,"+area+")")
+	} else {
+		rr.setFormula(cell, fn+"("+area+")")
+	}
+
+	if rr.totals == nil {
+		rr.totals = make(map[*xlsx.Cell]bool)
+	}
+	rr.totals[cell] = true
+
+	return nil
+}
+
+// fixTotals writes zero into totals of ranges what have no elements, their
+// rows are deleted and formulas refer to #REF!.
+func (rr *renderer) fixTotals(rows []*xlsx.Row) {
+
+	if len(rr.totals) == 0 {
+		return
+	}
+
+	for _, row := range rows {
+		for _, cell := range row.Cells {
+			if rr.totals[cell] && strings.Contains(cell.Formula(), "#REF!") {
+				cell.SetFloatWithFormat(0, cell.NumFmt)
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package rbuilder
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/tealeg/xlsx"
+)
+
+// Формат даты ячейки, в шаблоне которой формат даты не задан.
+const (
+	defaultDateFormat     = "dd.mm.yyyy"
+	defaultDateTimeFormat = "dd.mm.yyyy hh:mm:ss"
+)
+
+// printTmpl prints value the same way as placeholder of the cell does.
+var printTmpl = template.Must(template.New("print").Parse("{{.}}"))
+
+// formulaFunc is {{formula "SUM(B2:B4)"}}: the cell gets the formula instead
+// of the value. Formula is written for the template cell, its relative
+// references move together with the cell like in Excel when the cell is
+// copied, so the formula of the range element refers to rows of the element.
+func formulaFunc(st *renderState, formula string) (string, error) {
+	formula = strings.TrimPrefix(formula, "=")
+	if formula == "" {
+		return "", errors.New("formula: empty formula")
+	}
+	st.directive(formulaDirective, formula)
+	return "", nil
+}
+
+// setFormula writes the formula of {{formula}} into the cell.
+func (rr *renderer) setFormula(cell *xlsx.Cell, formula string) {
+
+	if rr.delta != 0 {
+		formula = shiftFormula(formula, "", true, rowOffset(rr.delta))
+	}
+
+	// значение формулы вычисляется Excel при открытии файла
+	cell.Value = ""
+	cell.SetFormula(formula)
+
+	// ссылки формулы сдвигаются при добавлении и удалении строк
+	rr.refs = true
+}
+
+// setTyped applies directives of the cell c of the row and writes value of
+// the cell what consists of single {{pipeline}}. time.Time is written as
+// date and bool as boolean, other values are written as text of the
+// placeholder.
+func (rr *renderer) setTyped(row *xlsx.Row, c int, v interface{}, dirs []directive) error {
+
+	cell := cellAt(row, c)
+
+	written, err := rr.applyDirectives(cell, dirs)
+	if err != nil || written {
+		return err
+	}
+
+	if p, ok := v.(*time.Time); ok && p != nil {
+		v = *p
+	}
+
+	switch val := v.(type) {
+	case time.Time:
+		if cell.GetNumberFormat() == "@" {
+			break
+		}
+		setDate(cell, val, rr.report.Date1904)
+		return nil
+
+	case bool:
+		cell.SetBool(val)
+		return nil
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := printTmpl.Execute(buf, v); err != nil {
+		return err
+	}
+
+	return rr.setValue(row, c, buf.String(), nil)
+}
+
+// setDate writes date serial of Excel into the cell. Number format of the
+// template cell is kept if it is format of date.
+func setDate(cell *xlsx.Cell, t time.Time, date1904 bool) {
+
+	if t.IsZero() {
+		cell.SetString("")
+		return
+	}
+
+	format := cell.GetNumberFormat()
+	if !cell.IsTime() {
+		format = defaultDateFormat
+		if h, m, s := t.Clock(); h != 0 || m != 0 || s != 0 {
+			format = defaultDateTimeFormat
+		}
+	}
+
+	cell.SetDateTimeWithFormat(excelTime(t, date1904), format)
+}
+
+// excelTime returns date serial of Excel. Excel has no time zones, so the
+// time is written as it is shown in its location.
+func excelTime(t time.Time, date1904 bool) float64 {
+	y, m, d := t.Date()
+	h, min, s := t.Clock()
+	return xlsx.TimeToExcelTime(time.Date(y, m, d, h, min, s, t.Nanosecond(), time.UTC), date1904)
+}
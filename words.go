@@ -0,0 +1,167 @@
+package rbuilder
+
+import "strings"
+
+var (
+	onesRU = [...]string{"", "один", "два", "три", "четыре", "пять", "шесть", "семь", "восемь", "девять"}
+	// единицы женского рода: одна тысяча, две копейки
+	onesFemRU = [...]string{"", "одна", "две", "три", "четыре", "пять", "шесть", "семь", "восемь", "девять"}
+	teensRU   = [...]string{"десять", "одиннадцать", "двенадцать", "тринадцать", "четырнадцать", "пятнадцать",
+		"шестнадцать", "семнадцать", "восемнадцать", "девятнадцать"}
+	tensRU = [...]string{"", "", "двадцать", "тридцать", "сорок", "пятьдесят", "шестьдесят", "семьдесят",
+		"восемьдесят", "девяносто"}
+	hundredsRU = [...]string{"", "сто", "двести", "триста", "четыреста", "пятьсот", "шестьсот", "семьсот",
+		"восемьсот", "девятьсот"}
+
+	// разряды начиная с тысяч
+	scalesRU = [...]wordForms{
+		{ru: [3]string{"тысяча", "тысячи", "тысяч"}, feminine: true},
+		{ru: [3]string{"миллион", "миллиона", "миллионов"}},
+		{ru: [3]string{"миллиард", "миллиарда", "миллиардов"}},
+		{ru: [3]string{"триллион", "триллиона", "триллионов"}},
+		{ru: [3]string{"квадриллион", "квадриллиона", "квадриллионов"}},
+		{ru: [3]string{"квинтиллион", "квинтиллиона", "квинтиллионов"}},
+	}
+
+	onesEN  = [...]string{"", "one", "two", "three", "four", "five", "six", "seven", "eight", "nine"}
+	teensEN = [...]string{"ten", "eleven", "twelve", "thirteen", "fourteen", "fifteen", "sixteen",
+		"seventeen", "eighteen", "nineteen"}
+	tensEN   = [...]string{"", "", "twenty", "thirty", "forty", "fifty", "sixty", "seventy", "eighty", "ninety"}
+	scalesEN = [...]string{"thousand", "million", "billion", "trillion", "quadrillion", "quintillion"}
+)
+
+// pluralRU returns index of the Russian noun form for n items: 0 for
+// "один рубль", 1 for "два рубля" and 2 for "пять рублей".
+func pluralRU(n int64) int {
+	n %= 100
+	switch {
+	case n >= 11 && n <= 14:
+		return 2
+	case n%10 == 1:
+		return 0
+	case n%10 >= 2 && n%10 <= 4:
+		return 1
+	}
+	return 2
+}
+
+// pluralEN returns index of the English noun form for n items.
+func pluralEN(n int64) int {
+	if n == 1 {
+		return 0
+	}
+	return 1
+}
+
+// triadRU writes number 0..999 in Russian words.
+func triadRU(n int64, feminine bool) []string {
+
+	var words []string
+
+	if h := n / 100; h > 0 {
+		words = append(words, hundredsRU[h])
+	}
+
+	n %= 100
+	switch {
+	case n >= 10 && n < 20:
+		words = append(words, teensRU[n-10])
+		return words
+	case n >= 20:
+		words = append(words, tensRU[n/10])
+		n %= 10
+	}
+
+	if n > 0 {
+		if feminine {
+			words = append(words, onesFemRU[n])
+		} else {
+			words = append(words, onesRU[n])
+		}
+	}
+
+	return words
+}
+
+// numberWordsRU writes non negative n in Russian words, feminine is the
+// gender of the counted noun.
+func numberWordsRU(n int64, feminine bool) string {
+
+	if n == 0 {
+		return "ноль"
+	}
+
+	// разряды по три цифры начиная с младшего
+	var triads []int64
+	for ; n > 0; n /= 1000 {
+		triads = append(triads, n%1000)
+	}
+
+	var words []string
+	for i := len(triads) - 1; i >= 0; i-- {
+		t := triads[i]
+		if t == 0 {
+			continue
+		}
+		if i == 0 {
+			words = append(words, triadRU(t, feminine)...)
+			continue
+		}
+		scale := scalesRU[i-1]
+		words = append(words, triadRU(t, scale.feminine)...)
+		words = append(words, scale.ru[pluralRU(t)])
+	}
+
+	return strings.Join(words, " ")
+}
+
+// triadEN writes number 0..999 in English words.
+func triadEN(n int64) []string {
+
+	var words []string
+
+	if h := n / 100; h > 0 {
+		words = append(words, onesEN[h], "hundred")
+	}
+
+	n %= 100
+	switch {
+	case n >= 10 && n < 20:
+		words = append(words, teensEN[n-10])
+	case n >= 20 && n%10 > 0:
+		words = append(words, tensEN[n/10]+"-"+onesEN[n%10])
+	case n >= 20:
+		words = append(words, tensEN[n/10])
+	case n > 0:
+		words = append(words, onesEN[n])
+	}
+
+	return words
+}
+
+// numberWordsEN writes non negative n in English words.
+func numberWordsEN(n int64) string {
+
+	if n == 0 {
+		return "zero"
+	}
+
+	var triads []int64
+	for ; n > 0; n /= 1000 {
+		triads = append(triads, n%1000)
+	}
+
+	var words []string
+	for i := len(triads) - 1; i >= 0; i-- {
+		t := triads[i]
+		if t == 0 {
+			continue
+		}
+		words = append(words, triadEN(t)...)
+		if i > 0 {
+			words = append(words, scalesEN[i-1])
+		}
+	}
+
+	return strings.Join(words, " ")
+}